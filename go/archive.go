@@ -2,164 +2,253 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
-func IsTgzFile(filename string) (bool, error) {
-	// Vérifier l'extension
-	if !hasTgzExtension(filename) {
-		return false, nil
-	}
+// gzipMagic starts the gzip files, and so the chart archives
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// archiveFS holds the files of a chart archive (.tgz), read in memory in one pass.
+// Only the content of the files the plugin may read is kept: the other files are listed,
+// but cannot be read.
+type archiveFS struct {
+	// entries by path, "." being the root folder
+	entries map[string]*archiveEntry
+}
 
-	// Vérifier les magic bytes et la structure
-	return validateTgzStructure(filename)
+type archiveEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	// data of the file, nil if it is not kept
+	data []byte
+	// children are the names of the entries of a folder, sorted
+	children []string
 }
 
-func ExtractTgz(src, dest string) error {
-	// Ouvrir le fichier .tgz
-	file, err := os.Open(src)
+// isArchive tells if a content is a chart archive: a gzip file holding a tar file
+func isArchive(r io.Reader) bool {
+	gzr, err := gzip.NewReader(r)
 	if err != nil {
-		return fmt.Errorf("erreur ouverture fichier: %v", err)
+		return false
 	}
-	defer file.Close()
+	defer gzr.Close()
+	_, err = tar.NewReader(gzr).Next()
+	return err == nil
+}
 
-	// Créer un lecteur gzip
-	gzr, err := gzip.NewReader(file)
+// readArchive reads a chart archive in one pass. keep tells which files are read.
+// The archives are recognized by their content: it returns nil, without error, if the
+// content is not an archive.
+func readArchive(r io.Reader, keep func(name string) bool) (*archiveFS, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil || !bytes.Equal(magic, gzipMagic) {
+		return nil, nil
+	}
+	gzr, err := gzip.NewReader(br)
 	if err != nil {
-		return fmt.Errorf("erreur création lecteur gzip: %v", err)
+		return nil, nil
 	}
 	defer gzr.Close()
 
-	// Créer un lecteur tar
+	archive := &archiveFS{entries: map[string]*archiveEntry{
+		".": {name: ".", mode: fs.ModeDir | 0755},
+	}}
 	tr := tar.NewReader(gzr)
-
-	// Créer le dossier de destination
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		return fmt.Errorf("erreur création dossier destination: %v", err)
-	}
-
-	// Extraire chaque fichier
-	for {
+	for first := true; ; first = false {
 		header, err := tr.Next()
 		if err == io.EOF {
-			break // Fin de l'archive
+			break
 		}
 		if err != nil {
-			return fmt.Errorf("erreur lecture header tar: %v", err)
+			if first {
+				// gzip, but not tar
+				return nil, nil
+			}
+			return nil, fmt.Errorf("bad archive: %v", err)
 		}
 
-		// Construire le chemin de destination de manière sécurisée
-		target := filepath.Join(dest, header.Name)
-
-		// Sécurité: vérifier que le chemin ne sort pas du dossier de destination
-		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("chemin non sécurisé: %s", header.Name)
+		name := path.Clean(strings.TrimPrefix(filepath.ToSlash(header.Name), "./"))
+		if !fs.ValidPath(name) || name == "." {
+			return nil, fmt.Errorf("unsafe path %s in archive", header.Name)
 		}
 
-		// Traiter selon le type de fichier
 		switch header.Typeflag {
 		case tar.TypeDir:
-			// Créer le dossier
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("erreur création dossier %s: %v", target, err)
-			}
-
+			archive.addDir(name)
 		case tar.TypeReg:
-			// Créer le fichier
-			if err := extractFile(tr, target, header); err != nil {
-				return fmt.Errorf("erreur extraction fichier %s: %v", target, err)
+			entry := &archiveEntry{name: path.Base(name), mode: fs.FileMode(header.Mode).Perm(), size: header.Size, modTime: header.ModTime}
+			if keep(name) {
+				if entry.data, err = io.ReadAll(tr); err != nil {
+					return nil, fmt.Errorf("cannot read %s in archive: %v", name, err)
+				}
 			}
-
-		case tar.TypeSymlink:
-			// Créer le lien symbolique
-			if err := os.Symlink(header.Linkname, target); err != nil {
-				return fmt.Errorf("erreur création symlink %s: %v", target, err)
-			}
-
+			archive.addDir(path.Dir(name))
+			archive.add(name, entry)
 		default:
-			fmt.Printf("Type de fichier non supporté: %c dans %s\n", header.Typeflag, header.Name)
+			Fdebug("Skipping %s in archive: unsupported type %c", header.Name, header.Typeflag)
 		}
 	}
 
-	return nil
+	for _, entry := range archive.entries {
+		sort.Strings(entry.children)
+	}
+	return archive, nil
 }
 
-func extractFile(tr *tar.Reader, target string, header *tar.Header) error {
-	// Créer les dossiers parents si nécessaire
-	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-		return err
+// addDir adds a folder, and its parents
+func (a *archiveFS) addDir(name string) {
+	if _, exists := a.entries[name]; exists {
+		return
 	}
+	a.addDir(path.Dir(name))
+	a.add(name, &archiveEntry{name: path.Base(name), mode: fs.ModeDir | 0755})
+}
 
-	// Créer le fichier
-	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-	if err != nil {
-		return err
+func (a *archiveFS) add(name string, entry *archiveEntry) {
+	if _, exists := a.entries[name]; !exists {
+		parent := a.entries[path.Dir(name)]
+		parent.children = append(parent.children, entry.name)
 	}
-	defer f.Close()
+	a.entries[name] = entry
+}
 
-	// Copier le contenu
-	if _, err := io.Copy(f, tr); err != nil {
-		return err
+func (a *archiveFS) lookup(op string, name string) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
 	}
-
-	return nil
+	entry, exists := a.entries[name]
+	if !exists {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
 }
 
-func hasTgzExtension(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	if ext == ".tgz" {
-		return true
+// Open implements fs.FS
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	entry, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
 	}
-
-	// Vérifier .tar.gz
-	if ext == ".gz" {
-		base := strings.TrimSuffix(filename, ext)
-		return strings.ToLower(filepath.Ext(base)) == ".tar"
+	if !entry.mode.IsDir() && entry.data == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errNotKept}
 	}
-
-	return false
+	file := &archiveFile{entry: entry, reader: bytes.NewReader(entry.data)}
+	if entry.mode.IsDir() {
+		file.dirEntries, _ = a.ReadDir(name)
+	}
+	return file, nil
 }
 
-func validateTgzStructure(filename string) (bool, error) {
-	file, err := os.Open(filename)
+// errNotKept is the error reading a file of an archive whose content is not kept
+var errNotKept = errors.New("content not read from the archive")
+
+// ReadFile implements fs.ReadFileFS
+func (a *archiveFS) ReadFile(name string) ([]byte, error) {
+	entry, err := a.lookup("read", name)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	if entry.data == nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errNotKept}
 	}
-	defer file.Close()
+	return append([]byte{}, entry.data...), nil
+}
 
-	// Vérifier les magic bytes gzip (1f 8b)
-	magicBytes := make([]byte, 2)
-	if _, err := file.Read(magicBytes); err != nil {
-		return false, err
+// ReadDir implements fs.ReadDirFS
+func (a *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, 0, len(entry.children))
+	for _, child := range entry.children {
+		entries = append(entries, fs.FileInfoToDirEntry(a.entries[path.Join(name, child)].info()))
 	}
+	return entries, nil
+}
 
-	if magicBytes[0] != 0x1f || magicBytes[1] != 0x8b {
-		return false, nil
+// Stat implements fs.StatFS
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := a.lookup("stat", name)
+	if err != nil {
+		return nil, err
 	}
+	return entry.info(), nil
+}
+
+func (e *archiveEntry) info() fs.FileInfo {
+	return archiveInfo{e}
+}
 
-	// Revenir au début du fichier
-	file.Seek(0, 0)
+// archiveInfo implements fs.FileInfo for the entries of an archive
+type archiveInfo struct {
+	entry *archiveEntry
+}
 
-	// Essayer de créer un lecteur gzip
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		return false, nil // Pas une erreur, juste pas un gzip valide
+func (i archiveInfo) Name() string       { return i.entry.name }
+func (i archiveInfo) Size() int64        { return i.entry.size }
+func (i archiveInfo) Mode() fs.FileMode  { return i.entry.mode }
+func (i archiveInfo) ModTime() time.Time { return i.entry.modTime }
+func (i archiveInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i archiveInfo) Sys() interface{}   { return nil }
+
+// archiveFile is a file of an archive opened
+type archiveFile struct {
+	entry      *archiveEntry
+	reader     *bytes.Reader
+	dirEntries []fs.DirEntry
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry.info(), nil }
+func (f *archiveFile) Read(b []byte) (int, error) { return f.reader.Read(b) }
+func (f *archiveFile) Close() error               { return nil }
+
+// ReadDir implements fs.ReadDirFile
+func (f *archiveFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 || n >= len(f.dirEntries) {
+		entries := f.dirEntries
+		f.dirEntries = nil
+		if n > 0 && len(entries) == 0 {
+			return nil, io.EOF
+		}
+		return entries, nil
 	}
-	defer gzr.Close()
+	entries := f.dirEntries[:n]
+	f.dirEntries = f.dirEntries[n:]
+	return entries, nil
+}
 
-	// Essayer de créer un lecteur tar
-	tr := tar.NewReader(gzr)
+func hasTgzExtension(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".tgz" {
+		return true
+	}
 
-	// Essayer de lire au moins un header tar
-	_, err = tr.Next()
-	if err != nil {
-		return false, nil // Pas un tar valide
+	// Vérifier .tar.gz
+	if ext == ".gz" {
+		base := strings.TrimSuffix(filename, ext)
+		return strings.ToLower(filepath.Ext(base)) == ".tar"
 	}
 
-	return true, nil
+	return false
 }
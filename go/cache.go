@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultCacheMaxAge  = 30 * 24 * time.Hour
+	defaultCacheMaxSize = 1 << 30
+	// cacheTmpPrefix starts the names of the entries being written
+	cacheTmpPrefix = "tmp-"
+)
+
+// chartCache keeps the charts pulled from one run of the plugin to the next, in
+// $HELM_CACHE_HOME/rockvalues:
+//
+//	archives/<digest>/     the archives pulled, with their .prov file naming them
+//	refs/<digest>.yaml     the archive of a chart, by repository, name and version
+//
+// Archives are named by their sha256 digest, and read in memory by each run, never
+// extracted. The entries are written under a temporary name, then renamed, so that the runs
+// sharing the cache only see complete entries. Each run holds a shared lock on the cache, and the entries not used
+// for a while are evicted at the end of a run, when no other run uses the cache.
+type chartCache struct {
+	// dir of the cache, empty if it cannot be used: the charts are then pulled in the
+	// temporary folder only
+	dir    string
+	tmpDir string
+	// offline is set when the charts must not be pulled: they must be in the cache
+	offline bool
+	lock    *os.File
+}
+
+// cacheRef is the archive of a chart given by its repository, name and version
+type cacheRef struct {
+	Chart string `yaml:"chart"`
+	// Archive is the path of the archive in the archives folder
+	Archive string `yaml:"archive"`
+	// Digest of the manifest of an OCI chart, for its cosign signature
+	Digest string `yaml:"digest,omitempty"`
+}
+
+// openChartCache opens the cache and locks it for the run. Offline with offline=true or
+// ROCKVALUES_OFFLINE=true.
+func openChartCache(tmpDir string, offline bool) *chartCache {
+	cache := &chartCache{
+		tmpDir:  tmpDir,
+		offline: offline || os.Getenv("ROCKVALUES_OFFLINE") == "true",
+	}
+
+	dir := cacheDir()
+	if dir == "" {
+		Fdebug("No cache folder, charts are not cached")
+		return cache
+	}
+	for _, sub := range []string{"archives", "refs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			Fwarn("Cannot create the cache, charts are not cached: %v", err)
+			return cache
+		}
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		err = lockFile(lock, false)
+	}
+	if err != nil {
+		Fwarn("Cannot lock the cache, charts are not cached: %v", err)
+		if lock != nil {
+			lock.Close()
+		}
+		return cache
+	}
+	Fdebug("Using cache %s", dir)
+	cache.dir = dir
+	cache.lock = lock
+	return cache
+}
+
+// cacheDir returns the folder of the cache, in the cache folder of helm
+func cacheDir() string {
+	home := os.Getenv("HELM_CACHE_HOME")
+	if home == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		home = filepath.Join(userCache, "helm")
+	}
+	return filepath.Join(home, "rockvalues")
+}
+
+// close releases the cache, and evicts the old entries if no other run uses it
+func (c *chartCache) close() {
+	if c.lock == nil {
+		return
+	}
+	defer c.lock.Close()
+
+	if err := unlockFile(c.lock); err != nil {
+		Fdebug("Cannot unlock the cache: %v", err)
+		return
+	}
+	locked, err := tryLockFile(c.lock, true)
+	if err != nil || !locked {
+		Fdebug("Cache used by another run, not evicted")
+		return
+	}
+	c.evict(cacheMaxAge(), cacheMaxSize())
+	unlockFile(c.lock)
+}
+
+// cacheable tells if the archive of a chart is always the same, so that it can be found
+// in the cache: the charts with an exact version, the OCI charts pinned by digest, and the
+// charts given by the URL of their archive
+func cacheable(source *ChartSource) bool {
+	return source.IsArchive() || (source.IsOCI() && source.Digest != "") || (source.Version != "" && isExactVersion(source.Version))
+}
+
+// lookup returns the archive of a chart, its content and the digest of its OCI manifest, if
+// the chart is in the cache. The content is checked against the digest the archive is stored
+// under. With prov, the .prov file of the archive must be in the cache too.
+func (c *chartCache) lookup(source *ChartSource, prov bool) (string, []byte, string, bool) {
+	if c.dir == "" || !cacheable(source) {
+		return "", nil, "", false
+	}
+
+	refPath := c.refPath(source)
+	content, err := os.ReadFile(refPath)
+	if err != nil {
+		return "", nil, "", false
+	}
+	var ref cacheRef
+	if err := yaml.Unmarshal(content, &ref); err != nil || ref.Chart != source.String() {
+		Fdebug("Ignoring bad cache entry %s: %v", refPath, err)
+		return "", nil, "", false
+	}
+
+	archive := c.archivePath(ref.Archive)
+	if _, err := os.Stat(archive + ".prov"); prov && err != nil {
+		Fdebug("No provenance file in the cache for chart %s", source)
+		return "", nil, "", false
+	}
+	archiveContent, err := os.ReadFile(archive)
+	if err != nil {
+		return "", nil, "", false
+	}
+	if digest := contentDigest(archiveContent); digest != "sha256:"+filepath.Base(filepath.Dir(archive)) {
+		// Removed, so that the chart pulled again is stored in its place
+		Fwarn("Archive %s of the cache has digest %s, it is removed", archive, digest)
+		removeEntry(filepath.Dir(archive))
+		return "", nil, "", false
+	}
+	touch(refPath)
+	touch(filepath.Dir(archive))
+	return archive, archiveContent, ref.Digest, true
+}
+
+// store puts an archive pulled, and its .prov file, in the cache. It returns the archive
+// in the cache, or the archive given if it cannot be cached.
+func (c *chartCache) store(source *ChartSource, archive string, digest string) string {
+	if c.dir == "" {
+		return archive
+	}
+
+	sum, err := archiveDigest(archive)
+	if err != nil {
+		Fwarn("Cannot cache chart %s: %v", source, err)
+		return archive
+	}
+	// The archive keeps its name, given in its .prov file
+	name := sum + "/" + filepath.Base(archive)
+	target := c.archivePath(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		Fwarn("Cannot cache chart %s: %v", source, err)
+		return archive
+	}
+	touch(filepath.Dir(target))
+	for _, suffix := range []string{"", ".prov"} {
+		if _, err := os.Stat(archive + suffix); suffix != "" && err != nil {
+			continue
+		}
+		if err := c.install(archive+suffix, target+suffix); err != nil {
+			Fwarn("Cannot cache chart %s: %v", source, err)
+			return archive
+		}
+	}
+
+	if cacheable(source) {
+		content, err := yaml.Marshal(&cacheRef{Chart: source.String(), Archive: name, Digest: digest})
+		if err == nil {
+			err = c.writeFile(c.refPath(source), content)
+		}
+		if err != nil {
+			Fwarn("Cannot cache chart %s: %v", source, err)
+		}
+	}
+	Fdebug("Chart %s cached in %s", source, target)
+	return target
+}
+
+func (c *chartCache) archivePath(name string) string {
+	return filepath.Join(c.dir, "archives", filepath.FromSlash(name))
+}
+
+func (c *chartCache) refPath(source *ChartSource) string {
+	sum := sha256.Sum256([]byte(source.String()))
+	return filepath.Join(c.dir, "refs", hex.EncodeToString(sum[:])+".yaml")
+}
+
+// install copies a file in the cache, if it is not there yet
+func (c *chartCache) install(src string, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return c.writeFile(target, content)
+}
+
+// writeFile writes a file of the cache under a temporary name, then renames it
+func (c *chartCache) writeFile(target string, content []byte) error {
+	tmp := filepath.Join(filepath.Dir(target), cacheTmpPrefix+uuid.New().String())
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// cacheEntry is an archive of the cache, with its .prov file
+type cacheEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// evict removes the entries not used since maxAge, then the entries used the longest time
+// ago until the cache is not larger than maxSize, and the references to the archives removed
+func (c *chartCache) evict(maxAge time.Duration, maxSize int64) {
+	now := time.Now()
+	entries := make(map[string]*cacheEntry)
+	dir := filepath.Join(c.dir, "archives")
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		// Left by a run which stopped while writing it
+		if strings.HasPrefix(file.Name(), cacheTmpPrefix) {
+			if now.Sub(info.ModTime()) > time.Hour {
+				os.RemoveAll(path)
+			}
+			continue
+		}
+
+		entries[file.Name()] = &cacheEntry{path: path, size: pathSize(path), used: info.ModTime()}
+	}
+
+	var kept []*cacheEntry
+	var size int64
+	for sum, entry := range entries {
+		if now.Sub(entry.used) > maxAge {
+			Fdebug("Evicting %s from the cache, not used since %s", sum, entry.used.Format(time.RFC3339))
+			removeEntry(entry.path)
+			continue
+		}
+		kept = append(kept, entry)
+		size += entry.size
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].used.Before(kept[j].used) })
+	for _, entry := range kept {
+		if size <= maxSize {
+			break
+		}
+		Fdebug("Evicting %s from the cache, larger than %d bytes", entry.path, maxSize)
+		removeEntry(entry.path)
+		size -= entry.size
+	}
+
+	refs, _ := filepath.Glob(filepath.Join(c.dir, "refs", "*"))
+	for _, path := range refs {
+		var ref cacheRef
+		content, err := os.ReadFile(path)
+		if err == nil {
+			err = yaml.Unmarshal(content, &ref)
+		}
+		if err == nil && !strings.HasPrefix(filepath.Base(path), cacheTmpPrefix) {
+			_, err = os.Stat(c.archivePath(ref.Archive))
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}
+}
+
+// cacheMaxAge is given by ROCKVALUES_CACHE_MAX_AGE, as a duration (720h)
+func cacheMaxAge() time.Duration {
+	value := os.Getenv("ROCKVALUES_CACHE_MAX_AGE")
+	if value == "" {
+		return defaultCacheMaxAge
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		Fwarn("Invalid ROCKVALUES_CACHE_MAX_AGE %q, using %s", value, defaultCacheMaxAge)
+		return defaultCacheMaxAge
+	}
+	return age
+}
+
+// cacheMaxSize is given by ROCKVALUES_CACHE_MAX_SIZE, in bytes or with a K, M or G suffix
+func cacheMaxSize() int64 {
+	value := os.Getenv("ROCKVALUES_CACHE_MAX_SIZE")
+	if value == "" {
+		return defaultCacheMaxSize
+	}
+	number, unit := value, int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		number = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		Fwarn("Invalid ROCKVALUES_CACHE_MAX_SIZE %q, using %d bytes", value, defaultCacheMaxSize)
+		return defaultCacheMaxSize
+	}
+	return size * unit
+}
+
+// archiveDigest returns the sha256 digest of an archive, in hexadecimal
+func archiveDigest(archive string) (string, error) {
+	digest, err := fileDigest(archive)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(digest, "sha256:"), nil
+}
+
+// touch records the use of an entry of the cache
+func touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		Fdebug("Cannot touch %s: %v", path, err)
+	}
+}
+
+func pathSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func removeEntry(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		Fdebug("Cannot remove %s: %v", path, err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// ChartMetadata is the part of a Chart.yaml used by the plugin
+type ChartMetadata struct {
+	APIVersion   string        `yaml:"apiVersion"`
+	Name         string        `yaml:"name"`
+	Version      string        `yaml:"version"`
+	AppVersion   string        `yaml:"appVersion"`
+	Description  string        `yaml:"description"`
+	Dependencies []*Dependency `yaml:"dependencies"`
+}
+
+// Dependency is a dependency declared in a Chart.yaml, or in the requirements.yaml of legacy charts
+type Dependency struct {
+	Name       string   `yaml:"name"`
+	Version    string   `yaml:"version"`
+	Repository string   `yaml:"repository"`
+	Condition  string   `yaml:"condition"`
+	Tags       []string `yaml:"tags"`
+	Alias      string   `yaml:"alias"`
+	// ImportValues holds strings (exports form) and child/parent maps
+	ImportValues []interface{} `yaml:"import-values"`
+}
+
+// Key returns the key of the values of the dependency in the values of its parent
+func (d *Dependency) Key() string {
+	if d.Alias != "" {
+		return d.Alias
+	}
+	return d.Name
+}
+
+// subchart is a chart found in the charts/ folder of its parent
+type subchart struct {
+	// dir is the folder of the chart, on disk or in an archive
+	dir *chartFS
+	// metadata is nil if the Chart.yaml cannot be read
+	metadata *ChartMetadata
+	// fallbackName is the name of the folder holding the chart, used when there is no Chart.yaml
+	fallbackName string
+}
+
+func (s *subchart) name() string {
+	if s.metadata != nil && s.metadata.Name != "" {
+		return s.metadata.Name
+	}
+	return s.fallbackName
+}
+
+func (s *subchart) version() string {
+	if s.metadata != nil {
+		return s.metadata.Version
+	}
+	return ""
+}
+
+// chartDependency is a sub-chart with the key of its values in the values of its parent
+type chartDependency struct {
+	key   string
+	chart *subchart
+	// dependency is nil for charts of the charts/ folder not declared in the parent
+	dependency *Dependency
+}
+
+// loadChartMetadata reads the Chart.yaml of a chart. For legacy charts (apiVersion v1),
+// the dependencies are read in requirements.yaml
+func loadChartMetadata(chart *chartFS) (*ChartMetadata, error) {
+	content, err := chart.readFile("Chart.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata ChartMetadata
+	if err := yaml.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", chart.filePath("Chart.yaml"), err)
+	}
+
+	if len(metadata.Dependencies) == 0 {
+		content, err := chart.readFile("requirements.yaml")
+		if err == nil {
+			var requirements struct {
+				Dependencies []*Dependency `yaml:"dependencies"`
+			}
+			if err := yaml.Unmarshal(content, &requirements); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %v", chart.filePath("requirements.yaml"), err)
+			}
+			metadata.Dependencies = requirements.Dependencies
+		}
+	}
+
+	return &metadata, nil
+}
+
+// loadSubcharts returns the charts of the charts/ folder of a chart, folders and archives.
+// Archives are recognized by their content, and read in memory, as the archives they hold.
+func loadSubcharts(chartsDir *chartFS, ctx *searchContext) []*subchart {
+	var subcharts []*subchart
+
+	info, err := chartsDir.stat(".")
+	if err != nil || !info.IsDir() {
+		// No chart directory found, we are at the deepest level
+		return nil
+	}
+
+	entries, err := chartsDir.readDir(".")
+	if err != nil {
+		ctx.fail("Failed to read directory %s: %v", chartsDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// The entry is a directory, we assume it is a sub-chart
+			subcharts = append(subcharts, newSubchart(chartsDir.sub(entry.Name()), entry.Name()))
+			continue
+		}
+
+		// The archive is read once: its .prov file is checked against the bytes it is read from
+		tgzPath := chartsDir.filePath(entry.Name())
+		content, err := chartsDir.readFile(entry.Name())
+		if err != nil {
+			Fwarn("Error reading %s: %v", tgzPath, err)
+			continue
+		}
+		chart, err := archiveChart(content, tgzPath, ctx.keep)
+		if err != nil {
+			ctx.fail("Failed to read archive %s: %v", tgzPath, err)
+			continue
+		}
+		if chart == nil {
+			Fdebug("Skipping non-archive file: %s", entry.Name())
+			continue
+		}
+		Fdebug("Found archive: %s", entry.Name())
+
+		// The archives which are not part of a verified chart need their own .prov file.
+		// The archives read from an archive all come from verified archives
+		if ctx.verifier != nil && !chartsDir.archive {
+			if err := ctx.verifier.verifyProvenance(tgzPath, content); err != nil {
+				ctx.refuse("Sub-chart %s is not verified: %v", tgzPath, err)
+				continue
+			}
+			Finfo("Sub-chart %s verified", tgzPath)
+		}
+
+		subcharts = append(subcharts, newSubchart(chart, chart.name()))
+	}
+
+	return subcharts
+}
+
+func newSubchart(dir *chartFS, folderName string) *subchart {
+	metadata, err := loadChartMetadata(dir)
+	if err != nil {
+		Fwarn("Cannot read Chart.yaml of sub-chart %s, its values are put under %s: %v", dir, folderName, err)
+	}
+	return &subchart{dir: dir, metadata: metadata, fallbackName: folderName}
+}
+
+// chartDependencies gives the key of each sub-chart in the values of its parent, as helm does:
+// the alias of the dependency declared in the parent, or else the name of the chart.
+// A chart declared twice with 2 aliases is returned twice. The charts of the charts/ folder
+// which are not declared are kept, under their name.
+func chartDependencies(metadata *ChartMetadata, subcharts []*subchart) []*chartDependency {
+	var dependencies []*chartDependency
+	var declared []*Dependency
+	if metadata != nil {
+		declared = metadata.Dependencies
+	}
+
+	// Charts which are not declared
+Loop:
+	for _, chart := range subcharts {
+		for _, dependency := range declared {
+			if dependency != nil && chart.name() == dependency.Name && isCompatibleVersion(dependency.Version, chart.version()) {
+				continue Loop
+			}
+		}
+		dependencies = append(dependencies, &chartDependency{key: chart.name(), chart: chart})
+	}
+
+	// Declared dependencies, with their alias
+	for _, dependency := range declared {
+		if dependency == nil {
+			continue
+		}
+		chart := findSubchart(subcharts, dependency)
+		if chart == nil {
+			Fdebug("Dependency %s not found in the charts folder", dependency.Name)
+			continue
+		}
+		dependencies = append(dependencies, &chartDependency{key: dependency.Key(), chart: chart, dependency: dependency})
+	}
+
+	return dependencies
+}
+
+// findSubchart returns the first sub-chart with the name of the dependency and a version
+// matching its version constraint
+func findSubchart(subcharts []*subchart, dependency *Dependency) *subchart {
+	for _, chart := range subcharts {
+		if chart.name() == dependency.Name && isCompatibleVersion(dependency.Version, chart.version()) {
+			return chart
+		}
+	}
+	return nil
+}
+
+// isCompatibleVersion tells if the version of a chart matches the version constraint of a dependency
+func isCompatibleVersion(constraintStr string, version string) bool {
+	if constraintStr == "" || version == "" {
+		return true
+	}
+	constraint, err := semver.NewConstraint(constraintStr)
+	if err != nil {
+		return false
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	return constraint.Check(v)
+}
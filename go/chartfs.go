@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// chartFS is the folder of a chart, on disk or in an archive. Folders, archives and archives
+// nested in the charts/ folder of other archives are read the same way, through fs.FS: the
+// archives are read in memory, never extracted.
+type chartFS struct {
+	fsys fs.FS
+	// dir is the folder of the chart in fsys
+	dir string
+	// path of the chart in the messages: its folder, or the path of the archive followed by
+	// the folder in the archive
+	path string
+	// archive is set for the charts read from an archive
+	archive bool
+}
+
+// diskChart returns the chart of a folder
+func diskChart(dir string) *chartFS {
+	return &chartFS{fsys: os.DirFS(dir), dir: ".", path: dir}
+}
+
+// archiveChart reads a chart archive, keeping the files kept by keep. The archive holds one
+// folder, with the chart. It returns nil, without error, if the content is not an archive.
+func archiveChart(content []byte, archivePath string, keep func(string) bool) (*chartFS, error) {
+	archive, err := readArchive(bytes.NewReader(content), keep)
+	if archive == nil || err != nil {
+		return nil, err
+	}
+	entries, _ := archive.ReadDir(".")
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return nil, fmt.Errorf("archive %s does not contain 1 folder. Incorrect helm structure for helm chart", archivePath)
+	}
+	dir := entries[0].Name()
+	Fdebug("Folder found in %s: %s", archivePath, dir)
+	return &chartFS{fsys: archive, dir: dir, path: archivePath + string(os.PathSeparator) + dir, archive: true}, nil
+}
+
+// contentChart reads the chart archive of a file on disk from its content, read once by the
+// caller to verify the same bytes the chart is read from
+func contentChart(content []byte, archivePath string, keep func(string) bool) (*chartFS, error) {
+	chart, err := archiveChart(content, archivePath, keep)
+	if err == nil && chart == nil {
+		err = fmt.Errorf("%s is not a chart archive", archivePath)
+	}
+	return chart, err
+}
+
+// isArchiveFile tells if a file on disk is a chart archive, whatever its extension
+func isArchiveFile(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return isArchive(file)
+}
+
+func (c *chartFS) String() string {
+	return c.path
+}
+
+// name is the name of the folder of the chart
+func (c *chartFS) name() string {
+	if c.archive {
+		return path.Base(c.dir)
+	}
+	return filepath.Base(c.path)
+}
+
+// filePath is the path of a file of the chart in the messages
+func (c *chartFS) filePath(name string) string {
+	return c.path + string(os.PathSeparator) + name
+}
+
+// sub returns the chart of a folder of the chart
+func (c *chartFS) sub(name string) *chartFS {
+	return &chartFS{fsys: c.fsys, dir: path.Join(c.dir, name), path: c.filePath(name), archive: c.archive}
+}
+
+// resolve gives the file system and the name in it of a file of the chart. The files of the
+// charts on disk can be outside of their folder (../common/values.yaml), not the files of
+// the charts of an archive.
+func (c *chartFS) resolve(name string) (fs.FS, string, error) {
+	rel := path.Clean(filepath.ToSlash(name))
+	full := path.Join(c.dir, rel)
+	switch {
+	case fs.ValidPath(full) && !filepath.IsAbs(name) && rel != ".." && !strings.HasPrefix(rel, "../"):
+		return c.fsys, full, nil
+	case c.archive:
+		return nil, "", &fs.PathError{Op: "open", Path: c.filePath(name), Err: fs.ErrNotExist}
+	default:
+		diskPath := filepath.Join(c.path, name)
+		return os.DirFS(filepath.Dir(diskPath)), filepath.Base(diskPath), nil
+	}
+}
+
+func (c *chartFS) open(name string) (fs.File, error) {
+	fsys, name, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.Open(name)
+}
+
+func (c *chartFS) readFile(name string) ([]byte, error) {
+	fsys, name, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys, name)
+}
+
+func (c *chartFS) stat(name string) (fs.FileInfo, error) {
+	fsys, name, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsys, name)
+}
+
+func (c *chartFS) readDir(name string) ([]fs.DirEntry, error) {
+	fsys, name, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(fsys, name)
+}
+
+// chartAt returns the chart of a folder given relative to the chart, as the folders of the
+// file:// repositories
+func (c *chartFS) chartAt(dir string) (*chartFS, error) {
+	if filepath.IsAbs(dir) {
+		return diskChart(dir), nil
+	}
+	if !c.archive {
+		return diskChart(filepath.Join(c.path, dir)), nil
+	}
+	fsys, name, err := c.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &chartFS{fsys: fsys, dir: name, path: c.filePath(dir), archive: true}, nil
+}
+
+// chartFiles are the files the plugin reads in a chart, besides the values files requested
+var chartFiles = map[string]bool{
+	"Chart.yaml":        true,
+	"requirements.yaml": true,
+	"Chart.lock":        true,
+	"requirements.lock": true,
+	"values.yaml":       true,
+	schemaFile:          true,
+	listStrategiesFile:  true,
+}
+
+// archiveFilter tells which files of the archives are read in memory: the files of the charts
+// the plugin reads, the files of the charts/ folders which may be archives, and the files
+// which may be one of the valueFiles, in the chart or in a sub-chart. The other files are skipped.
+func archiveFilter(valueFiles []string) func(string) bool {
+	var literals []string
+	var patterns [][]string
+	for _, valueFile := range valueFiles {
+		if !isGlobPattern(valueFile) {
+			literals = append(literals, path.Clean(filepath.ToSlash(valueFile)))
+		} else if checkGlobPattern(valueFile) == nil {
+			patterns = append(patterns, strings.Split(path.Clean(filepath.ToSlash(valueFile)), "/"))
+		}
+	}
+
+	return func(name string) bool {
+		if chartFiles[path.Base(name)] || path.Base(path.Dir(name)) == "charts" {
+			return true
+		}
+		for _, literal := range literals {
+			if name == literal || strings.HasSuffix(name, "/"+literal) {
+				return true
+			}
+		}
+		parts := strings.Split(name, "/")
+		for _, pattern := range patterns {
+			for i := range parts {
+				if matchGlobParts(pattern, parts[i:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
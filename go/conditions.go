@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chartView returns the values seen by a chart, as far as they are known during the search:
+// the defaults of the chart (its values.yaml), overridden by the values of the requested
+// files of the chart, overridden by the values given by its parents. Null values delete
+// the values they override.
+// The maps given are not modified.
+func chartView(chart *chartFS, chartValues []map[string]interface{}, inherited map[string]interface{}) map[string]interface{} {
+	view := loadChartDefaults(chart)
+	for _, values := range chartValues {
+		mergeMaps(view, values)
+	}
+	if inherited != nil {
+		mergeMaps(view, inherited)
+	}
+	deleteNullValues(view)
+	return view
+}
+
+// deleteNullValues removes the keys set to null, as helm does when it coalesces the values:
+// a null deletes the value of the chart defaults
+func deleteNullValues(values map[string]interface{}) {
+	for key, value := range values {
+		switch v := value.(type) {
+		case nil:
+			delete(values, key)
+		case map[string]interface{}:
+			deleteNullValues(v)
+		}
+	}
+}
+
+// loadChartDefaults reads the values.yaml of a chart, empty if there is none
+func loadChartDefaults(chart *chartFS) map[string]interface{} {
+	defaults := make(map[string]interface{})
+
+	content, err := chart.readFile("values.yaml")
+	if err != nil {
+		return defaults
+	}
+	if err := yaml.Unmarshal(content, &defaults); err != nil || defaults == nil {
+		Fdebug("Cannot read the default values of %s: %v", chart, err)
+		return make(map[string]interface{})
+	}
+	return defaults
+}
+
+// dependencyEnabled evaluates the condition and tags of a dependency as helm does.
+// The tags are evaluated first: the dependency is enabled if one of its tags is true,
+// disabled if one is false and none is true. Then the first path of the condition
+// holding a boolean overrides the tags.
+// Dependencies which are not declared are always enabled.
+// It returns the reason when the dependency is disabled.
+func dependencyEnabled(dependency *Dependency, view map[string]interface{}, tags map[string]interface{}) (bool, string) {
+	if dependency == nil {
+		return true, ""
+	}
+
+	enabled := true
+	reason := ""
+
+	hasTrue, hasFalse := false, false
+	var falseTags []string
+	for _, tag := range dependency.Tags {
+		if value, ok := tags[tag].(bool); ok {
+			if value {
+				hasTrue = true
+			} else {
+				hasFalse = true
+				falseTags = append(falseTags, tag)
+			}
+		}
+	}
+	if !hasTrue && hasFalse {
+		enabled = false
+		reason = fmt.Sprintf("tags %s", strings.Join(falseTags, ", "))
+	}
+
+	for _, condition := range strings.Split(dependency.Condition, ",") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+		value, found := lookupValue(view, condition)
+		if !found {
+			continue
+		}
+		if b, ok := value.(bool); ok {
+			enabled = b
+			reason = fmt.Sprintf("condition %s", condition)
+			break
+		}
+		Fwarn("Condition path %s of dependency %s returned a non-bool value", condition, dependency.Key())
+	}
+
+	return enabled, reason
+}
+
+// lookupValue returns the value at a dotted path (a.b.c) of a values map
+func lookupValue(values map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = values
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// copyValues returns a deep copy of a values map
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		out[key] = copyValue(value)
+	}
+	return out
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyValues(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = copyValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chartLock is the Chart.lock of a chart, or the requirements.lock of legacy charts
+type chartLock struct {
+	Dependencies []*Dependency `yaml:"dependencies"`
+}
+
+// loadChartLock reads the lock file of a chart, nil if there is none
+func loadChartLock(chart *chartFS) *chartLock {
+	for _, name := range []string{"Chart.lock", "requirements.lock"} {
+		content, err := chart.readFile(name)
+		if err != nil {
+			continue
+		}
+		var lock chartLock
+		if err := yaml.Unmarshal(content, &lock); err != nil {
+			Fwarn("Cannot read %s of %s, versions of Chart.yaml are used: %v", name, chart, err)
+			return nil
+		}
+		return &lock
+	}
+	return nil
+}
+
+// lockedVersion returns the version of a dependency in the lock file, empty if it is not locked
+func (l *chartLock) lockedVersion(dependency *Dependency) string {
+	if l == nil {
+		return ""
+	}
+	for _, locked := range l.Dependencies {
+		if locked != nil && locked.Name == dependency.Name && locked.Repository == dependency.Repository {
+			return locked.Version
+		}
+	}
+	return ""
+}
+
+// fetchDependencies completes the sub-charts found in the charts/ folder of a chart with the
+// dependencies declared in its Chart.yaml which are missing, as helm dependency build would do:
+// they are pulled at the version of the lock file, or the version of Chart.yaml if there is no lock.
+// Dependencies with a file:// repository are read from their folder, relative to the chart.
+// With update, as with helm --dependency-update, all the declared dependencies are fetched at the
+// version of Chart.yaml, and their vendored copies are ignored.
+func fetchDependencies(chartDir *chartFS, metadata *ChartMetadata, subcharts []*subchart, update bool, ctx *searchContext) []*subchart {
+	if metadata == nil || len(metadata.Dependencies) == 0 {
+		return subcharts
+	}
+
+	if update {
+		var kept []*subchart
+	Loop:
+		for _, chart := range subcharts {
+			for _, dependency := range metadata.Dependencies {
+				if dependency != nil && chart.name() == dependency.Name {
+					Fdebug("Dependencies are updated, vendored chart %s of %s is ignored", chart.dir, chartDir)
+					continue Loop
+				}
+			}
+			kept = append(kept, chart)
+		}
+		subcharts = kept
+	}
+
+	var lock *chartLock
+	if !update {
+		lock = loadChartLock(chartDir)
+	}
+
+	for _, dependency := range metadata.Dependencies {
+		if dependency == nil || findSubchart(subcharts, dependency) != nil {
+			continue
+		}
+
+		version := dependency.Version
+		if locked := lock.lockedVersion(dependency); locked != "" {
+			version = locked
+		}
+
+		chart, err := fetchDependency(chartDir, dependency, version, ctx)
+		if err != nil {
+			ctx.fail("Cannot fetch dependency %s of %s: %v", dependency.Name, chartDir, err)
+			continue
+		}
+		subcharts = append(subcharts, chart)
+	}
+
+	return subcharts
+}
+
+// fetchDependency gets a dependency from its repository. Charts pulled are kept in the
+// search context, so that a chart declared under several aliases is pulled once.
+func fetchDependency(chartDir *chartFS, dependency *Dependency, version string, ctx *searchContext) (*subchart, error) {
+	repository := dependency.Repository
+
+	var source *ChartSource
+	switch {
+	case repository == "":
+		return nil, fmt.Errorf("not in the charts folder, and no repository to fetch it from")
+
+	case strings.HasPrefix(repository, "file://"):
+		dir, err := chartDir.chartAt(strings.TrimPrefix(repository, "file://"))
+		if err == nil {
+			_, err = dir.stat("Chart.yaml")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no chart in %s: %v", strings.TrimPrefix(repository, "file://"), err)
+		}
+		Fdebug("Dependency %s of %s read from %s", dependency.Name, chartDir, dir)
+		return newSubchart(dir, dependency.Name), nil
+
+	case strings.HasPrefix(repository, "@") || strings.HasPrefix(repository, "alias:"):
+		// Repository added with helm repo add
+		repoName := strings.TrimPrefix(strings.TrimPrefix(repository, "@"), "alias:")
+		source = &ChartSource{Chart: repoName + "/" + dependency.Name, Version: version}
+
+	case strings.HasPrefix(repository, ociScheme):
+		source = &ChartSource{Chart: strings.TrimSuffix(repository, "/") + "/" + dependency.Name, Version: version}
+
+	default:
+		source = &ChartSource{Chart: dependency.Name, Repo: repository, Version: version}
+	}
+
+	if _, err := resolveChartVersion(source, false); err != nil {
+		return nil, err
+	}
+
+	key := source.String()
+	if chart, exists := ctx.fetched[key]; exists {
+		return chart, nil
+	}
+
+	Fdebug("Fetching dependency %s of %s", source, chartDir)
+	dir, err := pullChart(source, ctx.tls, ctx.verifier, ctx.cache, ctx.keep)
+	if err != nil {
+		return nil, err
+	}
+
+	chart := newSubchart(dir, dependency.Name)
+	ctx.fetched[key] = chart
+	return chart, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// docMarkerKey names a document of a multi-document values file, to select it with the doc option
+const docMarkerKey = "$doc"
+
+// valuesDocument is a document of a values file
+type valuesDocument struct {
+	values map[string]interface{}
+	// node is the mapping node of the document, nil if it is not kept
+	node *yaml.Node
+}
+
+// decodeDocuments reads the documents of a values file, separated by ---. With a selector,
+// only the documents matching it are kept: the index of the document, starting at 0, or
+// the value of its $doc key, or a comma separated list of them (0,overlay).
+// The $doc key is not part of the values. The elements of the selector matching a document
+// are recorded in matched, if it is not nil.
+func decodeDocuments(content []byte, selector string, keepNodes bool, matched map[string]bool) ([]*valuesDocument, error) {
+	var documents []*valuesDocument
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for index := 0; ; index++ {
+		var document yaml.Node
+		if err := decoder.Decode(&document); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d: %v", index, err)
+		}
+
+		var values map[string]interface{}
+		if err := document.Decode(&values); err != nil {
+			return nil, fmt.Errorf("document %d: %v", index, err)
+		}
+
+		marker, hasMarker := values[docMarkerKey]
+		delete(values, docMarkerKey)
+		if selector != "" && !selectsDocument(selector, index, marker, hasMarker, matched) {
+			Fdebug("Document %d left out, not matching %s", index, selector)
+			continue
+		}
+
+		valuesDocument := &valuesDocument{values: values}
+		if keepNodes && len(document.Content) > 0 && document.Content[0].Kind == yaml.MappingNode {
+			root := document.Content[0]
+			for i := 0; i+1 < len(root.Content); i += 2 {
+				if root.Content[i].Value == docMarkerKey {
+					root.Content = append(root.Content[:i], root.Content[i+2:]...)
+					break
+				}
+			}
+			valuesDocument.node = root
+		}
+		documents = append(documents, valuesDocument)
+	}
+	return documents, nil
+}
+
+func selectsDocument(selector string, index int, marker interface{}, hasMarker bool, matched map[string]bool) bool {
+	selects := false
+	for _, selected := range strings.Split(selector, ",") {
+		if selected == strconv.Itoa(index) || (hasMarker && selected == fmt.Sprint(marker)) {
+			if matched != nil {
+				matched[selected] = true
+			}
+			selects = true
+		}
+	}
+	return selects
+}
+
+// checkDocuments reports the elements of the doc selector which match no document of the
+// files read, once the search is over
+func (c *searchContext) checkDocuments() {
+	if c.options.Doc == "" {
+		return
+	}
+	for _, selected := range strings.Split(c.options.Doc, ",") {
+		if !c.documents[selected] {
+			c.fail("Document %s not found in the files", selected)
+		}
+	}
+}
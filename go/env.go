@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"regexp"
+)
+
+// envPlaceholderRegexp matches ${VAR} and ${VAR:-default} placeholders, and $${ which
+// escapes a placeholder
+var envPlaceholderRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces the placeholders of a values file by the value of the environment
+// variables, as envsubst does: ${VAR} is replaced by the value of VAR, ${VAR:-default}
+// by default when VAR is unset or empty. $${VAR} is kept as ${VAR}.
+// Other uses of $ ($VAR, $(cmd)...) are left untouched, as are the placeholders of the
+// variables which are unset and have no default, which it returns.
+func expandEnv(content []byte) ([]byte, []string) {
+	var unset []string
+	expanded := envPlaceholderRegexp.ReplaceAllFunc(content, func(match []byte) []byte {
+		if string(match) == "$${" {
+			return []byte("${")
+		}
+		groups := envPlaceholderRegexp.FindSubmatch(match)
+		name := string(groups[1])
+		value, exists := os.LookupEnv(name)
+		if value != "" {
+			return []byte(value)
+		}
+		// The default is nil when not given, empty for ${VAR:-}
+		if groups[2] != nil {
+			return groups[2]
+		}
+		if !exists {
+			unset = append(unset, name)
+			return match
+		}
+		return []byte(value)
+	})
+	return expanded, unset
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var inputFormats = []string{"yaml", "json", "toml"}
+
+// valuesFormat gives the format of a values file: the format option, else its extension.
+// Files without a known extension are read as YAML.
+func valuesFormat(valueFile string, ctx *searchContext) string {
+	if ctx.options.Format != "" {
+		return ctx.options.Format
+	}
+	switch strings.ToLower(path.Ext(valueFile)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	default:
+		return "yaml"
+	}
+}
+
+// decodeValues reads the content of a values file in its format. Only YAML files can hold
+// several documents, and keep their layout. Without ctx, all the documents are read, and
+// the selected documents are not recorded.
+func decodeValues(content []byte, format string, ctx *searchContext) ([]*valuesDocument, error) {
+	var values map[string]interface{}
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("unexpected content after the JSON object")
+		}
+	case "toml":
+		if err := toml.Unmarshal(content, &values); err != nil {
+			return nil, err
+		}
+	default:
+		if ctx == nil {
+			return decodeDocuments(content, "", false, nil)
+		}
+		return decodeDocuments(content, ctx.options.Doc, ctx.options.Preserve, ctx.documents)
+	}
+
+	// Values of the same types as the values read in YAML files
+	normalized, _ := normalizeValue(values).(map[string]interface{})
+	return []*valuesDocument{{values: normalized}}, nil
+}
+
+// normalizeValue converts the numbers, tables and dates of JSON and TOML files to the types
+// of the YAML parser
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeValue(item)
+		}
+		return v
+	case []map[string]interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = normalizeValue(item)
+		}
+		return out
+	case json.Number:
+		if i, err := strconv.Atoi(v.String()); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case int64:
+		return int(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
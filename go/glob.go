@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isGlobPattern tells if a value file given in a chart:// URI is a pattern
+// (values.d/*.yaml, **/values-dev.yaml...) instead of a literal path
+func isGlobPattern(valueFile string) bool {
+	return strings.ContainsAny(valueFile, "*?[")
+}
+
+// checkGlobPattern validates the syntax of a pattern.
+// path.Match only reports errors when it reaches them, so each part is checked here.
+func checkGlobPattern(pattern string) error {
+	for _, part := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// globChartFiles returns the files of a chart matching pattern, in lexical order.
+// The pattern uses the path.Match syntax, plus "**" which matches any number of folders.
+// The charts/ folder of the chart is never searched: sub-charts are visited on their own.
+func globChartFiles(chart *chartFS, pattern string) ([]string, error) {
+	if err := checkGlobPattern(pattern); err != nil {
+		return nil, err
+	}
+	patternParts := strings.Split(path.Clean(filepath.ToSlash(pattern)), "/")
+
+	var matches []string
+	err := fs.WalkDir(chart.fsys, chart.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == chart.dir {
+			return nil
+		}
+		rel := strings.TrimPrefix(filePath, chart.dir+"/")
+		if chart.dir == "." {
+			rel = filePath
+		}
+		if entry.IsDir() {
+			if rel == "charts" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if matchGlobParts(patternParts, strings.Split(rel, "/")) {
+			matches = append(matches, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchGlobParts matches a path against a pattern, both split on "/"
+func matchGlobParts(patternParts []string, pathParts []string) bool {
+	if len(patternParts) == 0 {
+		return len(pathParts) == 0
+	}
+
+	if patternParts[0] == "**" {
+		// "**" matches zero or more folders
+		for i := 0; i <= len(pathParts); i++ {
+			if matchGlobParts(patternParts[1:], pathParts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(pathParts) == 0 {
+		return false
+	}
+	matched, err := path.Match(patternParts[0], pathParts[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchGlobParts(patternParts[1:], pathParts[1:])
+}
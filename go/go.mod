@@ -3,7 +3,12 @@ module rockvalues
 go 1.22.2
 
 require (
-    gopkg.in/yaml.v3 v3.0.1
-	dario.cat/mergo v1.0.2
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.4.0
+	github.com/Masterminds/semver/v3 v3.2.1
 	github.com/google/uuid v1.6.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// importValues moves the values of a sub-chart into the namespace of its parent, as the
+// import-values of the dependency in the parent Chart.yaml ask for:
+//
+//   - exports form: "data" imports the table exports.data of the sub-chart at the root of the parent
+//   - child/parent form: {child: a.b, parent: c.d} imports the table a.b of the sub-chart at c.d in the parent
+//
+// Only tables can be imported. The values are imported into the local values of the layer.
+// The values of the parent chart itself are merged afterwards and take precedence.
+func importValues(dependency *Dependency, key string, layer valuesLayer) {
+	if dependency == nil || len(dependency.ImportValues) == 0 {
+		return
+	}
+	child, ok := layer.localMap[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	imported := make(map[string]interface{})
+	for _, importValue := range dependency.ImportValues {
+		var childPath, parentPath string
+		switch iv := importValue.(type) {
+		case string:
+			childPath = "exports." + iv
+			parentPath = "."
+		case map[string]interface{}:
+			childPath, _ = iv["child"].(string)
+			parentPath, _ = iv["parent"].(string)
+			if childPath == "" || parentPath == "" {
+				Fwarn("Invalid import-values %v of dependency %s: child and parent are required", iv, key)
+				continue
+			}
+		default:
+			Fwarn("Invalid import-values %v of dependency %s", importValue, key)
+			continue
+		}
+
+		value, found := lookupValue(child, childPath)
+		table, isTable := value.(map[string]interface{})
+		if !found || !isTable {
+			Fdebug("No table %s in the values of %s to import", childPath, key)
+			continue
+		}
+
+		Fdebug("Importing %s of %s into %s", childPath, key, parentPath)
+		mergeMaps(imported, pathToMap(parentPath, table))
+	}
+
+	mergeMaps(layer.localMap, imported)
+}
+
+// pathToMap nests data under a dotted path: a.b gives {a: {b: data}}. "." is the root.
+func pathToMap(path string, data map[string]interface{}) map[string]interface{} {
+	if path == "." || path == "" {
+		return data
+	}
+	keys := strings.Split(path, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		data = map[string]interface{}{keys[i]: data}
+	}
+	return data
+}
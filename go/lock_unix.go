@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile locks a file, shared or exclusive, waiting for the other locks to be released
+func lockFile(f *os.File, exclusive bool) error {
+	return syscall.Flock(int(f.Fd()), lockMode(exclusive))
+}
+
+// tryLockFile locks a file if it is not locked by another process, and tells if it did
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), lockMode(exclusive)|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+func lockMode(exclusive bool) int {
+	if exclusive {
+		return syscall.LOCK_EX
+	}
+	return syscall.LOCK_SH
+}
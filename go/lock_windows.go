@@ -0,0 +1,35 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile locks a file, shared or exclusive, waiting for the other locks to be released
+func lockFile(f *os.File, exclusive bool) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), lockFlags(exclusive), 0, 1, 0, &windows.Overlapped{})
+}
+
+// tryLockFile locks a file if it is not locked by another process, and tells if it did
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), lockFlags(exclusive)|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
+
+func lockFlags(exclusive bool) uint32 {
+	if exclusive {
+		return windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return 0
+}
@@ -16,6 +16,10 @@ func Fdebug(format string, args ...interface{}) {
 	}
 }
 
+func Finfo(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "get_values [info] "+format+"\n", args...)
+}
+
 func Ftrace(format string, args ...interface{}) {
 	if os.Getenv("HELM_TRACE") != "" {
 		fmt.Fprintf(os.Stderr, "get_values [trace] "+format+"\n", args...)
@@ -23,7 +27,7 @@ func Ftrace(format string, args ...interface{}) {
 }
 
 func LogError(msg string) {
-	Ferror(msg)
+	Ferror("%s", msg)
 }
 
 func Ferror(msg string, args ...interface{}) {
@@ -31,7 +35,7 @@ func Ferror(msg string, args ...interface{}) {
 }
 
 func Warn(msg string) {
-	Fwarn(msg)
+	Fwarn("%s", msg)
 }
 
 func Fwarn(msg string, args ...interface{}) {
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Directives of a list patch, written in a values file in place of a list:
+//
+//	env:
+//	  $patch: merge        # replace, append, prepend or merge
+//	  $mergeKey: name      # key identifying the items, for merge only
+//	  $items:
+//	    - name: LOG_LEVEL
+//	      value: debug
+const (
+	patchDirective    = "$patch"
+	mergeKeyDirective = "$mergeKey"
+	itemsDirective    = "$items"
+)
+
+var listStrategies = []string{"replace", "append", "prepend", "merge"}
+
+// listStrategiesFile is the file of a chart giving the strategies of its lists
+const listStrategiesFile = ".rockvalues.yaml"
+
+// listPatch is a list given with a strategy, combined with the list it overrides
+// once the values are merged
+type listPatch struct {
+	Strategy string
+	MergeKey string
+	Items    []interface{}
+}
+
+// listStrategy is the strategy of the lists at a path, in .rockvalues.yaml
+type listStrategy struct {
+	Patch    string `yaml:"patch"`
+	MergeKey string `yaml:"mergeKey"`
+}
+
+// chartConfig is the content of .rockvalues.yaml
+type chartConfig struct {
+	// Lists gives the strategy of lists by path (containers.env). A * in the path matches any key
+	Lists map[string]listStrategy `yaml:"lists"`
+}
+
+// mergeMaps merges src into dest, with src overriding dest. Maps are merged recursively,
+// other values are replaced, unless src gives a list patch.
+// The maps and lists of src are copied in dest: src is never changed by later merges.
+func mergeMaps(dest, src map[string]interface{}) {
+	for key, value := range src {
+		dest[key] = mergeValue(dest[key], value)
+	}
+}
+
+func mergeValue(dest interface{}, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		if d, ok := dest.(map[string]interface{}); ok {
+			mergeMaps(d, s)
+			return d
+		}
+		return copyValues(s)
+	case *listPatch:
+		return s.apply(dest)
+	default:
+		return copyValue(s)
+	}
+}
+
+// apply combines the patch with the list it overrides. Without list, the patch is
+// kept to be applied to the list of a file merged later.
+// Lists given by other files are never modified.
+func (p *listPatch) apply(dest interface{}) interface{} {
+	switch d := dest.(type) {
+	case []interface{}:
+		return p.applyTo(d)
+	case *listPatch:
+		return &listPatch{Strategy: d.Strategy, MergeKey: d.MergeKey, Items: p.applyTo(d.Items)}
+	default:
+		return p
+	}
+}
+
+func (p *listPatch) applyTo(items []interface{}) []interface{} {
+	var out []interface{}
+	switch p.Strategy {
+	case "append":
+		out = append(append(out, items...), p.Items...)
+	case "prepend":
+		out = append(append(out, p.Items...), items...)
+	case "merge":
+		out = copyValue(items).([]interface{})
+	Loop:
+		for _, item := range p.Items {
+			if key, ok := mergeKeyOf(item, p.MergeKey); ok {
+				for i, existing := range out {
+					if existingKey, ok := mergeKeyOf(existing, p.MergeKey); ok && reflect.DeepEqual(key, existingKey) {
+						out[i] = mergeValue(existing, item)
+						continue Loop
+					}
+				}
+			}
+			out = append(out, item)
+		}
+	default:
+		out = p.Items
+	}
+	return out
+}
+
+// mergeKeyOf returns the value of the merge key of a list item
+func mergeKeyOf(item interface{}, mergeKey string) (interface{}, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	key, ok := m[mergeKey]
+	return key, ok
+}
+
+// resolveListPatches replaces the patches left in the values, which did not override
+// any list, by their items
+func resolveListPatches(values map[string]interface{}) {
+	for key, value := range values {
+		values[key] = resolveListPatch(value)
+	}
+}
+
+func resolveListPatch(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		resolveListPatches(v)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = resolveListPatch(item)
+		}
+	case *listPatch:
+		for i, item := range v.Items {
+			v.Items[i] = resolveListPatch(item)
+		}
+		if v.Items == nil {
+			return []interface{}{}
+		}
+		return v.Items
+	}
+	return value
+}
+
+// parseListPatches replaces the maps of the values holding patch directives by list patches
+func parseListPatches(values map[string]interface{}) error {
+	for key, value := range values {
+		parsed, err := parseListPatch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		values[key] = parsed
+	}
+	return nil
+}
+
+func parseListPatch(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if _, exists := v[patchDirective]; !exists {
+			return v, parseListPatches(v)
+		}
+		return newListPatch(v)
+	case []interface{}:
+		for i, item := range v {
+			parsed, err := parseListPatch(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = parsed
+		}
+	}
+	return value, nil
+}
+
+func newListPatch(directives map[string]interface{}) (*listPatch, error) {
+	patch := &listPatch{}
+	for key, value := range directives {
+		var ok bool
+		switch key {
+		case patchDirective:
+			patch.Strategy, ok = value.(string)
+		case mergeKeyDirective:
+			patch.MergeKey, ok = value.(string)
+		case itemsDirective:
+			if value == nil {
+				ok = true
+				break
+			}
+			patch.Items, ok = value.([]interface{})
+		default:
+			return nil, fmt.Errorf("unknown key %s in a list patch", key)
+		}
+		if !ok {
+			return nil, fmt.Errorf("bad value for %s: %v", key, value)
+		}
+	}
+
+	if err := checkListStrategy(patch.Strategy, patch.MergeKey); err != nil {
+		return nil, err
+	}
+	for i, item := range patch.Items {
+		parsed, err := parseListPatch(item)
+		if err != nil {
+			return nil, err
+		}
+		patch.Items[i] = parsed
+	}
+	return patch, nil
+}
+
+func checkListStrategy(strategy string, mergeKey string) error {
+	for _, s := range listStrategies {
+		if s == strategy {
+			if strategy == "merge" && mergeKey == "" {
+				return fmt.Errorf("%s is needed to merge lists", mergeKeyDirective)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("list strategy must be one of %s, not %q", strings.Join(listStrategies, ", "), strategy)
+}
+
+// loadChartConfig reads the .rockvalues.yaml of a chart, nil if there is none
+func loadChartConfig(chart *chartFS) (*chartConfig, error) {
+	content, err := chart.readFile(listStrategiesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config chartConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	for path, strategy := range config.Lists {
+		if err := checkListStrategy(strategy.Patch, strategy.MergeKey); err != nil {
+			return nil, fmt.Errorf("lists %s: %v", path, err)
+		}
+	}
+	return &config, nil
+}
+
+// applyListStrategies turns the lists of the values found at the paths of the config into
+// patches. Lists already given as patches keep their directives.
+func (c *chartConfig) applyListStrategies(values map[string]interface{}) {
+	if c == nil {
+		return
+	}
+	for path, strategy := range c.Lists {
+		patchListsAt(values, strings.Split(path, "."), strategy)
+	}
+}
+
+func patchListsAt(values map[string]interface{}, path []string, strategy listStrategy) {
+	for key, value := range values {
+		if path[0] != "*" && path[0] != key {
+			continue
+		}
+		if len(path) > 1 {
+			if m, ok := value.(map[string]interface{}); ok {
+				patchListsAt(m, path[1:], strategy)
+			}
+			continue
+		}
+		if list, ok := value.([]interface{}); ok {
+			values[key] = &listPatch{Strategy: strategy.Patch, MergeKey: strategy.MergeKey, Items: list}
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the aggregated values:
+//
+//	yaml  nested values. With a width, the strings making a line too long are written
+//	      double quoted over several lines, the line breaks being escaped
+//	json  nested values, on a single line with indent=0. With a width, the maps and lists
+//	      fitting in a line are written on one line
+//	flat  one key.path=value line per value, escaped as helm --set reads them. With a width,
+//	      long lines end with a \ and go on in the next line, indented: for display only,
+//	      --set cannot read the wrapped lines
+//	env   one export KEY_PATH="value" line per value. With a width, long values end with
+//	      a \ and go on at the start of the next line, as sh reads them
+var outputFormats = []string{"yaml", "json", "flat", "env"}
+
+// defaultIndents is the indentation of each output format when the indent option is not given
+var defaultIndents = map[string]int{"yaml": 4, "json": 2, "flat": 2, "env": 0}
+
+// marshalValues writes the aggregated values in the output format of the options
+func marshalValues(values map[string]interface{}, options URIOptions, sources []*valuesSource) ([]byte, error) {
+	indent := options.Indent
+	if indent < 0 {
+		indent = defaultIndents[options.Output]
+	}
+
+	switch options.Output {
+	case "json":
+		return marshalJSON(values, indent, options.Width)
+	case "flat":
+		return marshalFlat(values, indent, options.Width), nil
+	case "env":
+		return marshalEnv(values, options.Width)
+	default:
+		node := &yaml.Node{}
+		var err error
+		if options.Preserve {
+			node, err = preservedNode(values, sources)
+		} else {
+			err = node.Encode(values)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return marshalYAML(node, indent, options.Width)
+	}
+}
+
+// marshalYAML writes a node with an indentation, wrapping the strings of the lines
+// longer than width (0 for no limit)
+func marshalYAML(node *yaml.Node, indent int, width int) ([]byte, error) {
+	// The strings which may be wrapped are replaced by placeholders, whose column
+	// in the output tells the room left for them
+	marks := &stringMarks{prefix: "rockvalues" + strings.ReplaceAll(uuid.New().String(), "-", "")}
+	if width > 0 {
+		marks.mark(node)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	if len(marks.strings) == 0 {
+		return buf.Bytes(), nil
+	}
+
+	placeholderRegexp := regexp.MustCompile(marks.prefix + `[0-9]+`)
+	lines := strings.Split(buf.String(), "\n")
+	for i, line := range lines {
+		loc := placeholderRegexp.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		original := marks.strings[line[loc[0]:loc[1]]]
+		column := utf8.RuneCountInString(line[:loc[0]])
+
+		value, err := wrapYAMLString(original, column, width)
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = line[:loc[0]] + value + line[loc[1]:]
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// stringMarks are the strings of a node replaced by placeholders
+type stringMarks struct {
+	prefix  string
+	strings map[string]*yaml.Node
+}
+
+// mark replaces by placeholders the single-line strings with spaces, which can be wrapped.
+// Keys and the values of flow maps and lists are kept.
+func (m *stringMarks) mark(node *yaml.Node) {
+	if node.Style&yaml.FlowStyle != 0 {
+		return
+	}
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			m.mark(child)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			m.mark(node.Content[i+1])
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" || node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 ||
+			!strings.Contains(node.Value, " ") || strings.Contains(node.Value, "\n") {
+			return
+		}
+		if m.strings == nil {
+			m.strings = make(map[string]*yaml.Node)
+		}
+		placeholder := m.prefix + strconv.Itoa(len(m.strings))
+		original := *node
+		m.strings[placeholder] = &original
+		node.Value = placeholder
+		node.Style = 0
+		node.Tag = "!!str"
+	}
+}
+
+// wrapYAMLString writes a string starting at column, double quoted over several lines if
+// it makes the line longer than width. The lines are broken after spaces, and continue
+// below the start of the string. A string which cannot be broken is written as it was.
+func wrapYAMLString(node *yaml.Node, column int, width int) (string, error) {
+	quoted := strconv.Quote(node.Value)
+	tokens := escapedTokens(quoted[1 : len(quoted)-1])
+	lines := wrapTokens(tokens, column+1, column+1, width, func(i int) bool {
+		return tokens[i-1] == " " && tokens[i] != " "
+	})
+	if len(lines) > 1 {
+		indent := strings.Repeat(" ", column+1)
+		return `"` + strings.Join(lines, "\\\n"+indent) + `"`, nil
+	}
+
+	out, err := yaml.Marshal(&yaml.Node{Kind: yaml.ScalarNode, Tag: node.Tag, Style: node.Style, Value: node.Value})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// marshalJSON writes the values indented, or on a single line if indent is 0. With a
+// width, maps and lists are written on one line when they fit.
+func marshalJSON(values map[string]interface{}, indent int, width int) ([]byte, error) {
+	var out []byte
+	var err error
+	switch {
+	case indent == 0:
+		out, err = json.Marshal(values)
+	case width == 0:
+		out, err = json.MarshalIndent(values, "", strings.Repeat(" ", indent))
+	default:
+		var buf bytes.Buffer
+		err = writeJSON(&buf, values, indent, width, 0, 0)
+		out = buf.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// writeJSON writes a value starting at column, at a depth of indentation
+func writeJSON(buf *bytes.Buffer, value interface{}, indent int, width int, depth int, column int) error {
+	inline, err := inlineJSON(value)
+	if err != nil {
+		return err
+	}
+	// The value is followed by a comma, except the last one
+	if column+utf8.RuneCount(inline)+1 <= width {
+		buf.Write(inline)
+		return nil
+	}
+
+	prefix := strings.Repeat(" ", indent*(depth+1))
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			break
+		}
+		keys := sortedKeys(v)
+		buf.WriteString("{\n")
+		for i, key := range keys {
+			k, _ := json.Marshal(key)
+			buf.WriteString(prefix)
+			buf.Write(k)
+			buf.WriteString(": ")
+			if err := writeJSON(buf, v[key], indent, width, depth+1, len(prefix)+utf8.RuneCount(k)+2); err != nil {
+				return err
+			}
+			if i < len(keys)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(strings.Repeat(" ", indent*depth) + "}")
+		return nil
+	case []interface{}:
+		if len(v) == 0 {
+			break
+		}
+		buf.WriteString("[\n")
+		for i, item := range v {
+			buf.WriteString(prefix)
+			if err := writeJSON(buf, item, indent, width, depth+1, len(prefix)); err != nil {
+				return err
+			}
+			if i < len(v)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(strings.Repeat(" ", indent*depth) + "]")
+		return nil
+	}
+	buf.Write(inline)
+	return nil
+}
+
+// inlineJSON writes a value on one line, with spaces after the colons and commas
+func inlineJSON(value interface{}) ([]byte, error) {
+	var parts [][]byte
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			k, _ := json.Marshal(key)
+			item, err := inlineJSON(v[key])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, append(append(k, ": "...), item...))
+		}
+		return append(append([]byte("{"), bytes.Join(parts, []byte(", "))...), '}'), nil
+	case []interface{}:
+		for _, item := range v {
+			out, err := inlineJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, out)
+		}
+		return append(append([]byte("["), bytes.Join(parts, []byte(", "))...), ']'), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// marshalFlat writes a key.path=value line per value, with the escapes of helm --set:
+// a \ before the . [ = , and \ of the keys, and before the , and \ of the values and a
+// { starting them. Line breaks, which --set cannot give, are written \n. Empty lists are
+// written {}, empty maps are left out. Lines longer than width end with a \ and go on
+// in the next line, after indent spaces, for display only. The values are written without their type:
+// --set reads strings like "123" or "true" as numbers and booleans, and floats as strings.
+func marshalFlat(values map[string]interface{}, indent int, width int) []byte {
+	var buf bytes.Buffer
+	flattenValues(values, nil, func(path []interface{}, value interface{}) {
+		var line strings.Builder
+		line.WriteString(flatKey(path))
+		line.WriteString("=")
+
+		var text string
+		switch v := value.(type) {
+		case map[string]interface{}:
+			return
+		case []interface{}:
+			text = "{}"
+		case string:
+			text = escapeFlat(v, ",\\")
+			if strings.HasPrefix(text, "{") {
+				text = `\` + text
+			}
+			text = strings.ReplaceAll(text, "\n", `\n`)
+		default:
+			text = flatScalar(v)
+		}
+
+		tokens := escapedTokens(text)
+		lines := wrapTokens(tokens, utf8.RuneCountInString(line.String()), indent, width, func(i int) bool {
+			return tokens[i] != " "
+		})
+		buf.WriteString(line.String())
+		buf.WriteString(strings.Join(lines, "\\\n"+strings.Repeat(" ", indent)))
+		buf.WriteString("\n")
+	})
+	return buf.Bytes()
+}
+
+// marshalEnv writes an export KEY_PATH="value" line per value. The names are the keys and
+// list indexes in upper case joined by _, the characters which cannot be in a name being
+// replaced by _. Values whose paths give the same name are an error. Empty maps and lists
+// are left out. Values longer than width end with a \ and go on at the start of the next
+// line.
+func marshalEnv(values map[string]interface{}, width int) ([]byte, error) {
+	var buf bytes.Buffer
+	var errs []error
+	names := make(map[string]string)
+	flattenValues(values, nil, func(path []interface{}, value interface{}) {
+		var text string
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+			return
+		case string:
+			text = v
+		default:
+			text = flatScalar(v)
+		}
+
+		name := envName(path)
+		if other, found := names[name]; found {
+			errs = append(errs, fmt.Errorf("values %s and %s have the same environment variable name %s", other, flatKey(path), name))
+			return
+		}
+		names[name] = flatKey(path)
+
+		start := "export " + name + `="`
+		tokens := escapedTokens(escapeFlat(text, "\\\"$`"))
+		lines := wrapTokens(tokens, len(start), 0, width, func(i int) bool { return true })
+		buf.WriteString(start)
+		buf.WriteString(strings.Join(lines, "\\\n"))
+		buf.WriteString("\"\n")
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return buf.Bytes(), nil
+}
+
+// flattenValues calls fn for each value which is not a map or a list, and for each empty
+// map or list, with its path: keys and list indexes. Keys are sorted.
+func flattenValues(value interface{}, path []interface{}, fn func(path []interface{}, value interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && len(path) > 0 {
+			fn(path, v)
+		}
+		for _, key := range sortedKeys(v) {
+			flattenValues(v[key], append(path[:len(path):len(path)], key), fn)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fn(path, v)
+		}
+		for i, item := range v {
+			flattenValues(item, append(path[:len(path):len(path)], i), fn)
+		}
+	default:
+		fn(path, value)
+	}
+}
+
+// flatKey writes a path as --set reads it: keys joined by ., list indexes as [0]
+func flatKey(path []interface{}) string {
+	var key strings.Builder
+	for i, element := range path {
+		switch e := element.(type) {
+		case int:
+			fmt.Fprintf(&key, "[%d]", e)
+		case string:
+			if i > 0 {
+				key.WriteString(".")
+			}
+			key.WriteString(escapeFlat(e, ".[=,\\"))
+		}
+	}
+	return key.String()
+}
+
+func flatScalar(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprint(value)
+}
+
+var envNameRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
+
+func envName(path []interface{}) string {
+	parts := make([]string, 0, len(path))
+	for _, element := range path {
+		parts = append(parts, strings.ToUpper(fmt.Sprint(element)))
+	}
+	name := envNameRegexp.ReplaceAllString(strings.Join(parts, "_"), "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// escapeFlat puts a \ before the characters of chars
+func escapeFlat(s string, chars string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// escapedTokens cuts a string in characters, a \ and the character it escapes making one
+// token. The \x, \u and \U escapes are followed by 2, 4 and 8 hexadecimal digits.
+func escapedTokens(s string) []string {
+	var tokens []string
+	for s != "" {
+		_, n := utf8.DecodeRuneInString(s)
+		if s[0] == '\\' && len(s) > 1 {
+			_, escaped := utf8.DecodeRuneInString(s[1:])
+			n = 1 + escaped
+			switch s[1] {
+			case 'x':
+				n += 2
+			case 'u':
+				n += 4
+			case 'U':
+				n += 8
+			}
+			if n > len(s) {
+				n = len(s)
+			}
+		}
+		tokens = append(tokens, s[:n])
+		s = s[n:]
+	}
+	return tokens
+}
+
+// wrapTokens cuts tokens in lines, the first one starting at column and the next ones at
+// nextColumn. The lines are cut where canCut allows it, before the token i, so that they
+// are not longer than width with the mark ending them. A line is never empty: it can be
+// longer than width when there is no place to cut it. When the first line has no room
+// left, it takes as much as the next ones. With a width of 0 there is a single line.
+func wrapTokens(tokens []string, column int, nextColumn int, width int, canCut func(i int) bool) []string {
+	var lines []string
+	var line strings.Builder
+	room := width - column
+	if room <= 1 {
+		room = width - nextColumn
+	}
+	length := 0
+	for i, token := range tokens {
+		if width > 0 && length > 0 && canCut(i) && length+chunkLength(tokens, i, canCut)+1 > room {
+			lines = append(lines, line.String())
+			line.Reset()
+			length = 0
+			room = width - nextColumn
+		}
+		line.WriteString(token)
+		length += utf8.RuneCountInString(token)
+	}
+	return append(lines, line.String())
+}
+
+// chunkLength is the length of the tokens from i to the next place to cut
+func chunkLength(tokens []string, i int, canCut func(i int) bool) int {
+	length := utf8.RuneCountInString(tokens[i])
+	for j := i + 1; j < len(tokens) && !canCut(j); j++ {
+		length += utf8.RuneCountInString(tokens[j])
+	}
+	return length
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
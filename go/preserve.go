@@ -0,0 +1,227 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// valuesSource is a values file as written, used to keep its comments, key order and
+// scalar styles in the aggregated values
+type valuesSource struct {
+	// root is the mapping node of the file
+	root *yaml.Node
+	// prefix is the path of the chart holding the file in the aggregated values
+	prefix []string
+	// rank of the file in the merge order: layer, then chart (sub-charts first), then file
+	layer, chart, file int
+	// loaded counts the files in the order they are read, parent charts first
+	loaded int
+}
+
+// sourceNodes are the nodes of the sources giving a value, indexed by path
+type sourceNodes struct {
+	keys   map[string]*yaml.Node
+	values map[string]*yaml.Node
+	// order gives the keys of each map in the order of the files
+	order map[string][]string
+	known map[string]bool
+}
+
+// addSources records the files of a chart, merged once its sub-charts are merged
+func (c *searchContext) addSources(sources []*valuesSource) {
+	c.chartOrder++
+	for _, source := range sources {
+		source.chart = c.chartOrder
+		c.sources = append(c.sources, source)
+	}
+}
+
+// indexSources indexes the nodes of the sources by path, the last file in the merge order
+// giving the node of a value. The keys are ordered as the files are read: the files of
+// a chart before the files of its sub-charts.
+func indexSources(sources []*valuesSource) *sourceNodes {
+	index := &sourceNodes{
+		keys:   make(map[string]*yaml.Node),
+		values: make(map[string]*yaml.Node),
+		order:  make(map[string][]string),
+		known:  make(map[string]bool),
+	}
+
+	sorted := append([]*valuesSource{}, sources...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		return a.loaded < b.loaded
+	})
+	for _, source := range sorted {
+		source.walk(func(path []string, key *yaml.Node, value *yaml.Node) {
+			index.addKey(path[:len(path)-1], path[len(path)-1])
+		})
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		if a.chart != b.chart {
+			return a.chart < b.chart
+		}
+		return a.file < b.file
+	})
+	for _, source := range sorted {
+		source.walk(func(path []string, key *yaml.Node, value *yaml.Node) {
+			if key != nil {
+				p := sourcePath(path)
+				index.keys[p] = key
+				index.values[p] = value
+			}
+		})
+	}
+	return index
+}
+
+// walk calls fn for each key of the file, with its path in the aggregated values.
+// The keys of the path of the chart are given without nodes.
+func (v *valuesSource) walk(fn func(path []string, key *yaml.Node, value *yaml.Node)) {
+	for i := 0; i+1 < len(v.root.Content); i += 2 {
+		key := v.root.Content[i].Value
+		// Global values and tags are shared by all the charts
+		path := append(append([]string{}, v.prefix...), key)
+		if key == "global" || key == "tags" {
+			path = []string{key}
+		}
+		for j := range path[:len(path)-1] {
+			fn(path[:j+1], nil, nil)
+		}
+		walkNode(path, v.root.Content[i], v.root.Content[i+1], fn)
+	}
+}
+
+func walkNode(path []string, key *yaml.Node, value *yaml.Node, fn func(path []string, key *yaml.Node, value *yaml.Node)) {
+	fn(path, key, value)
+	if value.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		walkNode(append(append([]string{}, path...), value.Content[i].Value), value.Content[i], value.Content[i+1], fn)
+	}
+}
+
+// addKey adds a key to the keys of its map, if it is not known yet
+func (s *sourceNodes) addKey(parent []string, name string) {
+	path := sourcePath(append(append([]string{}, parent...), name))
+	if !s.known[path] {
+		s.known[path] = true
+		parentPath := sourcePath(parent)
+		s.order[parentPath] = append(s.order[parentPath], name)
+	}
+}
+
+func sourcePath(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// preservedNode builds the node of the aggregated values, with the comments, key order
+// and scalar styles of the files the values come from. Keys which are not in the files
+// (imported values...) come last, sorted.
+func preservedNode(values map[string]interface{}, sources []*valuesSource) (*yaml.Node, error) {
+	index := indexSources(sources)
+	return index.mapNode(nil, values)
+}
+
+func (s *sourceNodes) mapNode(path []string, values map[string]interface{}) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range s.order[sourcePath(path)] {
+		if _, exists := values[key]; exists && !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	var others []string
+	for key := range values {
+		if !seen[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+
+	for _, key := range keys {
+		keyPath := append(append([]string{}, path...), key)
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+		if source := s.keys[sourcePath(keyPath)]; source != nil {
+			keyNode.Style = source.Style
+			keyNode.HeadComment = source.HeadComment
+			keyNode.LineComment = source.LineComment
+			keyNode.FootComment = source.FootComment
+		}
+
+		valueNode, err := s.valueNode(keyPath, values[key])
+		if err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, keyNode, valueNode)
+	}
+	return node, nil
+}
+
+func (s *sourceNodes) valueNode(path []string, value interface{}) (*yaml.Node, error) {
+	if m, ok := value.(map[string]interface{}); ok {
+		node, err := s.mapNode(path, m)
+		if err != nil {
+			return nil, err
+		}
+		if source := s.values[sourcePath(path)]; source != nil && source.Kind == yaml.MappingNode {
+			node.Style = source.Style & yaml.FlowStyle
+			node.LineComment = source.LineComment
+		}
+		return node, nil
+	}
+
+	// Scalars and lists are kept as written when the file gives the final value
+	if source := s.values[sourcePath(path)]; source != nil && source.Kind != yaml.MappingNode && !hasAlias(source) {
+		var sourceValue interface{}
+		if err := source.Decode(&sourceValue); err == nil && reflect.DeepEqual(sourceValue, value) {
+			return copyNode(source), nil
+		}
+	}
+
+	node := &yaml.Node{}
+	if err := node.Encode(value); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// hasAlias tells if a node uses an anchor (*alias), which cannot be copied alone
+func hasAlias(node *yaml.Node) bool {
+	if node.Kind == yaml.AliasNode {
+		return true
+	}
+	for _, child := range node.Content {
+		if hasAlias(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyNode copies a node, without its anchors
+func copyNode(node *yaml.Node) *yaml.Node {
+	out := *node
+	out.Anchor = ""
+	out.Content = nil
+	for _, child := range node.Content {
+		out.Content = append(out.Content, copyNode(child))
+	}
+	return &out
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// registryMaxSize is the largest document read from a registry
+const registryMaxSize = 16 << 20
+
+// helmChartLayerType is the media type of the layer holding the archive of a helm chart
+const helmChartLayerType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// registryClient reads the manifests and blobs of a repository of an OCI registry, with the
+// credentials of helm registry login
+type registryClient struct {
+	host       string
+	repository string
+	client     *http.Client
+	// authorization is the Authorization header, set once the registry asked for it
+	authorization string
+}
+
+// ociManifest is the part of an OCI image manifest used by the plugin
+type ociManifest struct {
+	Layers []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+var challengeParamRegexp = regexp.MustCompile(`([a-zA-Z]+)="([^"]*)"`)
+
+// newRegistryClient returns the client of the repository of a chart: oci://registry[:port]/path/name
+func newRegistryClient(chart string, files tlsFiles) (*registryClient, error) {
+	ref := strings.TrimPrefix(chart, ociScheme)
+	idx := strings.Index(ref, "/")
+	if idx == -1 {
+		return nil, fmt.Errorf("no repository in %s", chart)
+	}
+	client, err := newHTTPClient(files, false, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &registryClient{
+		host:       ref[:idx],
+		repository: ref[idx+1:],
+		client:     client,
+	}, nil
+}
+
+// manifest reads the manifest of a tag or a digest. A manifest read by digest is checked
+// against it.
+func (r *registryClient) manifest(reference string) (*ociManifest, error) {
+	content, err := r.get("manifests/"+reference, "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		sum := sha256.Sum256(content)
+		if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != reference {
+			return nil, fmt.Errorf("manifest %s has digest %s", reference, actual)
+		}
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %v", reference, err)
+	}
+	return &manifest, nil
+}
+
+// chartLayer returns the digest of the layer of a manifest holding the chart archive
+func (m *ociManifest) chartLayer() (string, error) {
+	for _, layer := range m.Layers {
+		if layer.MediaType == helmChartLayerType {
+			return layer.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no helm chart layer in the manifest")
+}
+
+// blob reads a blob, checking its digest
+func (r *registryClient) blob(digest string) ([]byte, error) {
+	content, err := r.get("blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return nil, fmt.Errorf("blob %s has digest %s", digest, actual)
+	}
+	return content, nil
+}
+
+func (r *registryClient) get(path string, accept string) ([]byte, error) {
+	target := "https://" + r.host + "/v2/" + r.repository + "/" + path
+	for {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if r.authorization != "" {
+			req.Header.Set("Authorization", r.authorization)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(io.LimitReader(resp.Body, registryMaxSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && r.authorization == "":
+			if err := r.authorize(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, fmt.Errorf("cannot log in %s: %v", r.host, err)
+			}
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("GET %s: %s", target, resp.Status)
+		default:
+			return content, nil
+		}
+	}
+}
+
+// authorize answers the challenge of the registry: basic credentials, or a token obtained
+// with them (anonymously without credentials)
+func (r *registryClient) authorize(challenge string) error {
+	username, password := registryCredentials(r.host)
+
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return fmt.Errorf("no credentials, use helm registry login")
+		}
+		r.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unknown authentication %q", challenge)
+	}
+
+	values := map[string]string{}
+	for _, match := range challengeParamRegexp.FindAllStringSubmatch(params, -1) {
+		values[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return fmt.Errorf("bad token realm %q", values["realm"])
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + r.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", realm.Redacted(), resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, registryMaxSize)).Decode(&token); err != nil {
+		return fmt.Errorf("bad token: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// registryCredentials returns the credentials saved by helm registry login for a registry,
+// in the file given by HELM_REGISTRY_CONFIG
+func registryCredentials(host string) (string, string) {
+	path := os.Getenv("HELM_REGISTRY_CONFIG")
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", ""
+		}
+		path = filepath.Join(configDir, "helm", "registry", "config.json")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		Fdebug("Cannot read registry credentials in %s: %v", path, err)
+		return "", ""
+	}
+	auth, ok := config.Auths[host]
+	if !ok {
+		return "", ""
+	}
+	if auth.Auth != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+			username, password, _ := strings.Cut(string(decoded), ":")
+			return username, password
+		}
+	}
+	return auth.Username, auth.Password
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// installedChartSource returns the source of the chart given to the parent helm command,
+// when it is not a local chart
+func installedChartSource(chart string, chartVersion string, chartRepo string) *ChartSource {
+	if strings.HasPrefix(chart, ociScheme) {
+		if source, err := parseOCISource(chart); err == nil {
+			if source.Version == "" {
+				source.Version = chartVersion
+			}
+			return source
+		}
+	}
+	return &ChartSource{Chart: chart, Version: chartVersion, Repo: chartRepo}
+}
+
+// pullChart downloads a chart, unless it is in the cache, and reads its archive in memory,
+// keeping the files kept by keep. The charts the plugin cannot download itself are pulled
+// with helm, with the TLS files given by helm. With a verifier, the archive is verified
+// before it is read.
+func pullChart(source *ChartSource, files tlsFiles, verifier *chartVerifier, cache *chartCache, keep func(string) bool) (*chartFS, error) {
+	prov := verifier != nil && !verifier.usesCosign(source)
+	archive, content, digest, found := cache.lookup(source, prov)
+	var err error
+	switch {
+	case found:
+		Fdebug("Chart %s found in the cache", source)
+	case cache.offline && !cacheable(source):
+		return nil, fmt.Errorf("chart %s has no exact version, it cannot be found in the cache offline", source)
+	case cache.offline:
+		return nil, fmt.Errorf("chart %s is not in the cache, and charts are not pulled offline", source)
+	default:
+		archiveDir := cache.tmpDir + string(os.PathSeparator) + uuid.New().String()
+		archive, err = downloadChart(source, archiveDir, files, prov)
+		if errors.Is(err, errHelmPull) {
+			Fdebug("Pulling chart %s with helm: %v", source, err)
+			archive, digest, err = helmPull(source, archiveDir, files, prov)
+		}
+		if err != nil {
+			return nil, err
+		}
+		archive = cache.store(source, archive, digest)
+	}
+
+	// The archive is read once, so that the chart is read from the bytes verified
+	if content == nil {
+		content, err = os.ReadFile(archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pulled chart %s: %v", source, err)
+		}
+	}
+	if verifier != nil {
+		switch {
+		case verifier.usesCosign(source) && cache.offline:
+			err = fmt.Errorf("cosign signatures are not checked offline")
+		case verifier.usesCosign(source):
+			err = verifier.verifyCosign(source, digest, content)
+		default:
+			err = verifier.verifyProvenance(archive, content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chart %s is not verified: %v", source, err)
+		}
+		Finfo("Chart %s verified", source)
+	}
+
+	chart, err := contentChart(content, archive, keep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pulled chart %s: %v", source, err)
+	}
+	return chart, nil
+}
+
+// helmPull pulls the archive of a chart with helm pull in archiveDir, with its .prov file
+// with prov. It returns the archive, and the digest of the OCI charts.
+func helmPull(source *ChartSource, archiveDir string, files tlsFiles, prov bool) (string, string, error) {
+	helm := os.Getenv("HELM_BIN")
+	if helm == "" {
+		helm = "helm"
+	}
+
+	ref := source.Chart
+	if source.IsOCI() && source.Digest != "" {
+		ref += "@" + source.Digest
+	}
+
+	var args []string
+	args = append(args, "pull")
+	args = append(args, ref)
+	if source.Repo != "" {
+		args = append(args, "--repo", source.Repo)
+	}
+	if source.Version != "" {
+		args = append(args, "--version", source.Version)
+	}
+	if files.certFile != "" {
+		args = append(args, "--cert-file", files.certFile)
+	}
+	if files.keyFile != "" {
+		args = append(args, "--key-file", files.keyFile)
+	}
+	if files.caFile != "" {
+		args = append(args, "--ca-file", files.caFile)
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return "", "", err
+	}
+	if prov {
+		args = append(args, "--prov")
+	}
+	args = append(args, "--debug", "--destination", archiveDir)
+
+	cmd := exec.Command(helm, args...)
+
+	// helm pull prints the pulled reference and digest of OCI charts on stdout,
+	// which is where the values are written: keep it away from the values
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	os.Stderr.Write(stdout.Bytes())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to pull chart %s: %v", source, err)
+	}
+
+	digest := pulledDigest(stdout.Bytes())
+	if source.Digest != "" {
+		if digest != source.Digest {
+			return "", "", fmt.Errorf("chart %s has digest %q, expected %s", source, digest, source.Digest)
+		}
+		Fdebug("Digest of chart %s checked", source)
+	}
+
+	archive, err := pulledArchive(archiveDir)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read pulled chart %s: %v", source, err)
+	}
+	return archive, digest, nil
+}
+
+// pulledArchive returns the chart archive written by helm pull in a folder
+func pulledArchive(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && hasTgzExtension(entry.Name()) {
+			return dir + string(os.PathSeparator) + entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("no chart archive in %s", dir)
+}
+
+// pulledDigest finds the digest printed by helm pull for OCI charts ("Digest: sha256:...")
+func pulledDigest(output []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Digest:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Digest:"))
+		}
+	}
+	return ""
+}
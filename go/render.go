@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// renderSuffix is the suffix of the values files always rendered as templates
+const renderSuffix = ".tpl.yaml"
+
+// renderContext is the data given to the values files rendered as Go templates:
+//
+//	{{ .Release.Name }} {{ .Release.Namespace }}  release being installed
+//	{{ .Chart.Name }} {{ .Chart.Version }}...     Chart.yaml of the chart holding the file
+//	{{ .Subchart }}                                path of that chart in the values (a.b), empty for the top chart
+type renderContext struct {
+	Release  renderRelease
+	Chart    *ChartMetadata
+	Subchart string
+}
+
+type renderRelease struct {
+	Name      string
+	Namespace string
+}
+
+// newRenderRelease gives the release of the parent helm command. Without -n, the namespace
+// is the one helm gives to plugins, else the default namespace.
+func newRenderRelease(helmCmd *HelmCommand) renderRelease {
+	release := renderRelease{Namespace: os.Getenv("HELM_NAMESPACE")}
+	if helmCmd != nil {
+		release.Name = helmCmd.Release
+		if helmCmd.Namespace != "" {
+			release.Namespace = helmCmd.Namespace
+		}
+	}
+	if release.Namespace == "" {
+		release.Namespace = "default"
+	}
+	return release
+}
+
+// needsRendering tells if a values file is a template
+func needsRendering(valueFile string, ctx *searchContext) bool {
+	return ctx.options.Render || strings.HasSuffix(valueFile, renderSuffix)
+}
+
+// renderValuesFile executes the content of a values file as a Go template.
+// The functions are a small subset of those of helm templates.
+func renderValuesFile(name string, content []byte, data *renderContext) ([]byte, error) {
+	tpl, err := template.New(name).Funcs(renderFuncs).Option("missingkey=zero").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+var renderFuncs = template.FuncMap{
+	"default": func(defaultValue interface{}, value ...interface{}) interface{} {
+		if len(value) == 0 || isEmptyValue(value[0]) {
+			return defaultValue
+		}
+		return value[0]
+	},
+	"required": func(message string, value interface{}) (interface{}, error) {
+		if isEmptyValue(value) {
+			return nil, fmt.Errorf("%s", message)
+		}
+		return value, nil
+	},
+	"quote": func(value interface{}) string {
+		return fmt.Sprintf("%q", fmt.Sprint(value))
+	},
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+	"env":        os.Getenv,
+	"toYaml": func(value interface{}) (string, error) {
+		out, err := yaml.Marshal(value)
+		return strings.TrimSuffix(string(out), "\n"), err
+	},
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	"nindent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return "\n" + pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+}
+
+// isEmptyValue tells if a value is empty for default and required, as in helm templates
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int:
+		return v == 0
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// errHelmPull tells that a chart cannot be downloaded by the plugin, and is pulled with helm
+var errHelmPull = errors.New("chart not downloadable without helm")
+
+// repoEntry is a repository of the repositories.yaml of helm repo add
+type repoEntry struct {
+	Name                  string `yaml:"name"`
+	URL                   string `yaml:"url"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	CertFile              string `yaml:"certFile"`
+	KeyFile               string `yaml:"keyFile"`
+	CAFile                string `yaml:"caFile"`
+	InsecureSkipTLSVerify bool   `yaml:"insecure_skip_tls_verify"`
+	PassCredentialsAll    bool   `yaml:"pass_credentials_all"`
+}
+
+// repoClient downloads the files of a helm repository, with its credentials and TLS settings
+type repoClient struct {
+	repo *repoEntry
+	// tls are the files given by helm, for the settings the repository does not give
+	tls    tlsFiles
+	client *http.Client
+}
+
+// downloadChart downloads the archive of a chart of a helm repository, or given by URL, in
+// dir, without helm: the charts of the repositories added with helm repo add are found
+// in the index of the helm cache, the charts of a repository given by URL in the index of
+// the repository. The TLS files given by helm are used for the settings the repository does
+// not give. With prov, the .prov file of the chart is downloaded too, if there is one.
+// It returns errHelmPull for the charts it cannot download: OCI charts, repositories which
+// are not in the helm configuration or whose index is not in the cache, or when
+// ROCKVALUES_HELM_PULL is set.
+func downloadChart(source *ChartSource, dir string, files tlsFiles, prov bool) (string, error) {
+	if os.Getenv("ROCKVALUES_HELM_PULL") == "true" {
+		return "", fmt.Errorf("%w: ROCKVALUES_HELM_PULL is set", errHelmPull)
+	}
+
+	var chartURL, digest string
+	var repo *repoEntry
+	switch {
+	case source.IsOCI():
+		return "", fmt.Errorf("%w: OCI chart", errHelmPull)
+
+	case source.IsArchive():
+		chartURL = source.Chart
+		repo = findRepo(func(r *repoEntry) bool { return strings.HasPrefix(chartURL, strings.TrimSuffix(r.URL, "/")+"/") })
+
+	default:
+		var index *repoIndex
+		var err error
+		if source.Repo != "" {
+			repo = findRepo(func(r *repoEntry) bool { return strings.TrimSuffix(r.URL, "/") == strings.TrimSuffix(source.Repo, "/") })
+			if repo == nil {
+				repo = &repoEntry{URL: source.Repo}
+			}
+			index, err = newRepoClient(repo, files).index()
+		} else {
+			repoName, _, found := strings.Cut(source.Chart, "/")
+			if !found {
+				return "", fmt.Errorf("%w: no repository in %s", errHelmPull, source.Chart)
+			}
+			repo = findRepo(func(r *repoEntry) bool { return r.Name == repoName })
+			if repo == nil {
+				return "", fmt.Errorf("%w: repository %s not in the helm configuration", errHelmPull, repoName)
+			}
+			index, err = loadRepoIndex(repoName)
+			if err == nil && index == nil {
+				return "", fmt.Errorf("%w: no index in the helm cache for repository %s", errHelmPull, repoName)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+
+		entry, err := findIndexEntry(index, source)
+		if err != nil {
+			return "", err
+		}
+		chartURL, err = resolveChartURL(repo.URL, entry)
+		if err != nil {
+			return "", err
+		}
+		digest = entry.Digest
+	}
+
+	if repo == nil {
+		repo = &repoEntry{}
+	}
+	client := newRepoClient(repo, files)
+
+	name := path.Base(chartURL)
+	if u, err := url.Parse(chartURL); err == nil {
+		name = path.Base(u.Path)
+	}
+	if !hasTgzExtension(name) {
+		name = source.Name() + ".tgz"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	archive := filepath.Join(dir, name)
+
+	Fdebug("Downloading chart %s from %s", source, chartURL)
+	content, err := client.get(chartURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download chart %s: %v", source, err)
+	}
+	// The digest of the index is the sha256 of the archive
+	if digest != "" {
+		sum := sha256.Sum256(content)
+		if actual := hex.EncodeToString(sum[:]); actual != strings.TrimPrefix(digest, "sha256:") {
+			return "", fmt.Errorf("chart %s has digest %s, the index gives %s", source, actual, digest)
+		}
+	}
+	if err := os.WriteFile(archive, content, 0644); err != nil {
+		return "", err
+	}
+
+	if prov {
+		content, err := client.get(chartURL + ".prov")
+		if err != nil {
+			// Reported when the chart is verified
+			Fdebug("No provenance file for chart %s: %v", source, err)
+		} else if err := os.WriteFile(archive+".prov", content, 0644); err != nil {
+			return "", err
+		}
+	}
+	return archive, nil
+}
+
+// findRepo returns the first repository of the helm configuration matching, nil if none does.
+// The configuration is the file given by HELM_REPOSITORY_CONFIG.
+func findRepo(match func(*repoEntry) bool) *repoEntry {
+	configPath := os.Getenv("HELM_REPOSITORY_CONFIG")
+	if configPath == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil
+		}
+		configPath = filepath.Join(configDir, "helm", "repositories.yaml")
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil
+	}
+
+	var config struct {
+		Repositories []*repoEntry `yaml:"repositories"`
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		Fwarn("Cannot read the repositories of %s: %v", configPath, err)
+		return nil
+	}
+	for _, repo := range config.Repositories {
+		if repo != nil && match(repo) {
+			return repo
+		}
+	}
+	return nil
+}
+
+// findIndexEntry returns the entry of the index for the version of a chart: the highest
+// version matching the version or constraint of the chart, the latest stable one without version
+func findIndexEntry(index *repoIndex, source *ChartSource) (*repoIndexEntry, error) {
+	entries, exists := index.Entries[source.Name()]
+	if !exists {
+		return nil, fmt.Errorf("chart %s not found in the index of its repository", source.Name())
+	}
+	for i := range entries {
+		if source.Version != "" && entries[i].Version == source.Version {
+			return &entries[i], nil
+		}
+	}
+
+	constraintStr := source.Version
+	if constraintStr == "" {
+		constraintStr = "*"
+	}
+	constraint, err := semver.NewConstraint(constraintStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version constraint %q for chart %s: %v", source.Version, source.Chart, err)
+	}
+	version, err := highestMatchingVersion(entries, constraint)
+	if err != nil {
+		return nil, fmt.Errorf("no version of chart %s matches %q: %v", source.Chart, constraintStr, err)
+	}
+	for i := range entries {
+		if entries[i].Version == version {
+			return &entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %s of chart %s not found", version, source.Chart)
+}
+
+// resolveChartURL returns the URL of the archive of an index entry, which may be relative
+// to the URL of the repository
+func resolveChartURL(repoURL string, entry *repoIndexEntry) (string, error) {
+	if len(entry.URLs) == 0 {
+		return "", fmt.Errorf("no URL for version %s in the index", entry.Version)
+	}
+	chartURL, err := url.Parse(entry.URLs[0])
+	if err != nil {
+		return "", fmt.Errorf("bad chart URL %q: %v", entry.URLs[0], err)
+	}
+	if chartURL.IsAbs() {
+		return chartURL.String(), nil
+	}
+	base, err := url.Parse(strings.TrimSuffix(repoURL, "/") + "/")
+	if err != nil {
+		return "", fmt.Errorf("bad repository URL %q: %v", repoURL, err)
+	}
+	return base.ResolveReference(chartURL).String(), nil
+}
+
+func newRepoClient(repo *repoEntry, files tlsFiles) *repoClient {
+	return &repoClient{repo: repo, tls: files}
+}
+
+// index downloads the index.yaml of the repository
+func (r *repoClient) index() (*repoIndex, error) {
+	indexURL := strings.TrimSuffix(r.repo.URL, "/") + "/index.yaml"
+	content, err := r.get(indexURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download index of repository %s: %v", r.repo.URL, err)
+	}
+	var index repoIndex
+	if err := yaml.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %v", indexURL, err)
+	}
+	return &index, nil
+}
+
+// get downloads a file. The credentials of the repository are only sent to its host,
+// unless pass_credentials_all is set, as helm does.
+func (r *repoClient) get(target string) ([]byte, error) {
+	if r.client == nil {
+		client, err := r.httpClient()
+		if err != nil {
+			return nil, err
+		}
+		r.client = client
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.repo.Username != "" || r.repo.Password != "" {
+		repoURL, err := url.Parse(r.repo.URL)
+		if r.repo.PassCredentialsAll || (err == nil && repoURL.Host == req.URL.Host) {
+			req.SetBasicAuth(r.repo.Username, r.repo.Password)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// httpClient returns a client with the TLS settings of the repository, completed by the
+// files given by helm to the downloader
+func (r *repoClient) httpClient() (*http.Client, error) {
+	files := tlsFiles{certFile: r.repo.CertFile, keyFile: r.repo.KeyFile, caFile: r.repo.CAFile}
+	if files.certFile == "" && files.keyFile == "" {
+		files.certFile, files.keyFile = r.tls.certFile, r.tls.keyFile
+	}
+	if files.caFile == "" {
+		files.caFile = r.tls.caFile
+	}
+	return newHTTPClient(files, r.repo.InsecureSkipTLSVerify, 5*time.Minute)
+}
+
+// tlsFiles are the client certificate, key and CA used to download the charts, given by
+// helm to the downloader (helm --cert-file, --key-file and --ca-file)
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// newHTTPClient returns a client with a client certificate and a CA, when they are given
+func newHTTPClient(files tlsFiles, insecure bool, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if files.certFile != "" && files.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(files.certFile, files.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client certificate %s: %v", files.certFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if files.caFile != "" {
+		content, err := os.ReadFile(files.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the CA: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate in %s", files.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsMetadataKey is the key of the metadata of a SOPS encrypted file
+const sopsMetadataKey = "sops"
+
+// sopsValueRegexp matches a value encrypted by SOPS
+var sopsValueRegexp = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMetadata is the part of the sops: block used to decrypt a file
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified     string `yaml:"lastmodified"`
+	MAC              string `yaml:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+}
+
+// sopsEncrypted tells if the decoded documents of a values file are encrypted with SOPS:
+// the file has a sops map with a MAC at its top level, whatever its format
+func sopsEncrypted(documents []*valuesDocument) bool {
+	for _, document := range documents {
+		if metadata, ok := document.values[sopsMetadataKey].(map[string]interface{}); ok {
+			if _, ok := metadata["mac"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decryptSopsFile decrypts in memory a values file found encrypted by sopsEncrypted.
+// sops writes YAML and JSON files only, both read as YAML to keep the order of the keys
+// the MAC is computed on.
+func decryptSopsFile(content []byte, format string) ([]*valuesDocument, error) {
+	if format == "toml" {
+		return nil, fmt.Errorf("SOPS encrypted TOML files are not supported")
+	}
+	root, metadata, err := sopsDocument(content)
+	if err != nil {
+		return nil, err
+	}
+	values, err := decryptSopsValues(root, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []*valuesDocument{{values: values, node: root}}, nil
+}
+
+// sopsDocument returns the document of a values file encrypted with SOPS, without its
+// SOPS metadata
+func sopsDocument(content []byte) (*yaml.Node, *sopsMetadata, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, nil, err
+	}
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("no SOPS metadata")
+	}
+	root := document.Content[0]
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != sopsMetadataKey {
+			continue
+		}
+		var metadata sopsMetadata
+		if err := root.Content[i+1].Decode(&metadata); err != nil {
+			return nil, nil, fmt.Errorf("bad SOPS metadata: %v", err)
+		}
+		// The metadata is not part of the values
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		return root, &metadata, nil
+	}
+	return nil, nil, fmt.Errorf("no SOPS metadata")
+}
+
+// decryptSopsValues decrypts in memory a values file encrypted by SOPS with age keys, and
+// checks its MAC. The keys are read in SOPS_AGE_KEY, SOPS_AGE_KEY_FILE, or the keys.txt
+// file of sops in the user config folder.
+func decryptSopsValues(root *yaml.Node, metadata *sopsMetadata) (map[string]interface{}, error) {
+	dataKey, err := sopsDataKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha512.New()
+	if err := decryptSopsNode(root, nil, dataKey, metadata, func(value []byte) { hash.Write(value) }); err != nil {
+		return nil, err
+	}
+
+	mac, err := decryptSopsValue(metadata.MAC, dataKey, metadata.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt MAC: %v", err)
+	}
+	if !strings.EqualFold(mac.Value, fmt.Sprintf("%X", hash.Sum(nil))) {
+		return nil, fmt.Errorf("MAC mismatch, the file has been modified")
+	}
+
+	var values map[string]interface{}
+	if err := root.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// decryptSopsNode decrypts the values of a node in place, walking it in the order of the
+// file as SOPS does. The path of a value (its keys, list items keeping the path of the list)
+// is the additional data of its encryption. Each value of the MAC is given to hash.
+func decryptSopsNode(node *yaml.Node, path []string, dataKey []byte, metadata *sopsMetadata, hash func([]byte)) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := append(append([]string{}, path...), node.Content[i].Value)
+			if err := decryptSopsNode(node.Content[i+1], keyPath, dataKey, metadata, hash); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := decryptSopsNode(item, path, dataKey, metadata, hash); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !sopsValueRegexp.MatchString(node.Value) {
+			if !metadata.MACOnlyEncrypted {
+				var value interface{}
+				if err := node.Decode(&value); err != nil {
+					return err
+				}
+				if value != nil {
+					hash(sopsMACBytes(value))
+				}
+			}
+			return nil
+		}
+
+		value, err := decryptSopsValue(node.Value, dataKey, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("cannot decrypt %s: %v", strings.Join(path, "."), err)
+		}
+		node.Value = value.Value
+		node.Tag = value.Tag
+		node.Style = 0
+		hash(value.macBytes)
+	}
+	return nil
+}
+
+// sopsValue is a decrypted value, with its YAML tag
+type sopsValue struct {
+	Value    string
+	Tag      string
+	macBytes []byte
+}
+
+// decryptSopsValue decrypts a ENC[AES256_GCM,data:...,iv:...,tag:...,type:...] value
+func decryptSopsValue(encrypted string, dataKey []byte, additionalData string) (*sopsValue, error) {
+	parts := sopsValueRegexp.FindStringSubmatch(encrypted)
+	if parts == nil {
+		return nil, fmt.Errorf("not a SOPS encrypted value")
+	}
+
+	var decoded [3][]byte
+	for i := range decoded {
+		var err error
+		if decoded[i], err = base64.StdEncoding.DecodeString(parts[i+1]); err != nil {
+			return nil, fmt.Errorf("bad encoding: %v", err)
+		}
+	}
+	data, iv, tag := decoded[0], decoded[1], decoded[2]
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+
+	value := &sopsValue{Value: string(plaintext)}
+	switch parts[4] {
+	case "str", "bytes":
+		value.Tag = "!!str"
+		value.macBytes = plaintext
+	case "int":
+		i, err := strconv.Atoi(value.Value)
+		if err != nil {
+			return nil, err
+		}
+		value.Tag = "!!int"
+		value.macBytes = sopsMACBytes(i)
+	case "float":
+		f, err := strconv.ParseFloat(value.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		value.Tag = "!!float"
+		value.macBytes = sopsMACBytes(f)
+	case "bool":
+		b, err := strconv.ParseBool(value.Value)
+		if err != nil {
+			return nil, err
+		}
+		value.Value = strconv.FormatBool(b)
+		value.Tag = "!!bool"
+		value.macBytes = sopsMACBytes(b)
+	default:
+		return nil, fmt.Errorf("unknown type %s", parts[4])
+	}
+	return value, nil
+}
+
+// sopsMACBytes gives a value as SOPS writes it in the MAC
+func sopsMACBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// sopsDataKey decrypts the data key of a file with the first age identity matching one
+// of its recipients
+func sopsDataKey(metadata *sopsMetadata) ([]byte, error) {
+	if len(metadata.Age) == 0 {
+		return nil, fmt.Errorf("no age recipient, only age keys are supported")
+	}
+
+	identities, err := sopsAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, recipient := range metadata.Age {
+		reader, err := age.Decrypt(armor.NewReader(strings.NewReader(recipient.Enc)), identities...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", recipient.Recipient, err))
+			continue
+		}
+		return io.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("cannot decrypt the data key: %s", strings.Join(errs, "; "))
+}
+
+// sopsAgeIdentities reads the age keys the way sops does
+func sopsAgeIdentities() ([]age.Identity, error) {
+	if keys := os.Getenv("SOPS_AGE_KEY"); keys != "" {
+		return age.ParseIdentities(strings.NewReader(keys))
+	}
+
+	keyFile := os.Getenv("SOPS_AGE_KEY_FILE")
+	if keyFile == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("no age key: SOPS_AGE_KEY_FILE is not set")
+		}
+		keyFile = filepath.Join(configDir, "sops", "age", "keys.txt")
+	}
+
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read age keys: %v", err)
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The chart:// scheme, as given to helm with -f:
+//
+//	chart-uri = "chart://" files [ "@" source ] [ "?" options ]
+//	files     = file *( "," file )
+//	source    = repo "/" name [ ":" version ]
+//	          | "oci://" registry "/" path [ ":" version ] [ "@" digest ]
+//	          | repo-url "//" name [ ":" version ]
+//	          | archive-url
+//	options   = option *( "&" option )
+//	option    = key "=" value
+//
+// Files are paths relative to the root of the charts, or patterns. They are
+// merged in order. Characters with a meaning in the URI (",", "@", "?", "%")
+// are written percent-encoded in file names.
+//
+// Without source, the files are taken from the chart being installed. With
+// a source, they are taken from that chart, which is pulled but not installed.
+// The registry of an OCI chart may have a port, and the digest (sha256:...)
+// pins the exact content of the chart. A repository URL (http or https) is
+// separated from the chart name by a double slash, and an archive URL is the
+// URL of a .tgz file: in both cases, no "helm repo add" is needed.
+//
+// The options start after the last "?". An archive URL with a query of its own
+// (https://host/chart-1.0.0.tgz?token=x) must be followed by a "?", with or
+// without options: chart://values.yaml@https://host/chart-1.0.0.tgz?token=x?
+//
+// Supported options:
+//
+//	subcharts=true|false  search the files in the dependencies too (default true)
+//	strict=true|false     fail on unreadable, unparsable or missing files, on missing
+//	                      documents, and on unset environment variables (default false)
+//	env=true|false        expand ${VAR} and ${VAR:-default} in the files (default false)
+//	render=true|false     render all the files as Go templates, not only *.tpl.yaml
+//	                      (default false)
+//	format=yaml|json|toml format of the files (default given by their extension, yaml
+//	                      if it is not .json or .toml)
+//	output=yaml|json|flat|env
+//	                      format of the aggregated values: YAML, JSON, key.path=value
+//	                      lines as given to --set, or export KEY_PATH="value" lines
+//	                      (default yaml)
+//	indent=N              indentation of the nested values, from 2 to 9 for yaml (default
+//	                      4), from 0 to 9 for json (default 2, 0 for a single line), and of
+//	                      the lines following a wrapped line for flat (default 2)
+//	width=N               width of the lines: longer values are wrapped, and json maps and
+//	                      lists fitting in a line are written on one line (default 0, no limit).
+//	                      Wrapped flat lines are for display only, --set cannot read them
+//	doc=index|name[,...]  read only the documents of the files with these indexes (from 0)
+//	                      or $doc keys (default all the documents, merged in order)
+//	preserve=true|false   keep the comments, key order and styles of the files in the
+//	                      aggregated values, with output=yaml only (default false)
+//	validate=true|false   check the aggregated values against the values.schema.json of
+//	                      the charts (default false)
+//	verify=true|false     verify the signatures of the charts pulled and of the archives
+//	                      of the charts/ folders (default false, true with helm --verify)
+//	offline=true|false    only use the charts of the cache, never pull them (default false,
+//	                      true with ROCKVALUES_OFFLINE=true)
+//	disabled=skip|report|include
+//	                      what to do with dependencies disabled by their condition
+//	                      or tags: leave them out, leave them out and log them, or
+//	                      keep their values anyway (default skip)
+const chartScheme = "chart://"
+
+// ChartURI is a parsed chart:// URI
+type ChartURI struct {
+	// Files to search, in merge order
+	Files []string
+	// Source is the chart holding the files, nil for the chart being installed
+	Source  *ChartSource
+	Options URIOptions
+}
+
+// ChartSource is the chart given after the "@" of a chart:// URI
+type ChartSource struct {
+	// Chart reference, as given to helm pull: repo/name or oci://registry/path/name
+	Chart string
+	// Version of the chart, empty for the latest one
+	Version string
+	// Digest of an OCI chart (sha256:...), empty if the content is not pinned
+	Digest string
+	// Repo is the URL of the repository, for charts given with helm --repo
+	// or with a repository URL in the URI
+	Repo string
+}
+
+const ociScheme = "oci://"
+
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+
+// URIOptions are the options given in the query of a chart:// URI
+type URIOptions struct {
+	Subcharts bool
+	Strict    bool
+	Env       bool
+	Render    bool
+	Preserve  bool
+	Validate  bool
+	Verify    bool
+	Offline   bool
+	Doc       string
+	Format    string
+	Output    string
+	Indent    int // -1 for the indentation of the output format
+	Width     int
+	Disabled  string
+}
+
+var defaultURIOptions = URIOptions{
+	Subcharts: true,
+	Strict:    false,
+	Env:       false,
+	Render:    false,
+	Preserve:  false,
+	Validate:  false,
+	Verify:    false,
+	Offline:   false,
+	Doc:       "",
+	Format:    "",
+	Output:    "yaml",
+	Indent:    -1,
+	Width:     0,
+	Disabled:  "skip",
+}
+
+var disabledModes = []string{"skip", "report", "include"}
+
+// ParseChartURI parses a chart:// URI. Errors explain what part of the URI is wrong.
+func ParseChartURI(raw string) (*ChartURI, error) {
+	if !strings.HasPrefix(raw, chartScheme) {
+		return nil, fmt.Errorf("invalid chart URI %q: must start with %s", raw, chartScheme)
+	}
+	rest := strings.TrimPrefix(raw, chartScheme)
+
+	uri := &ChartURI{Options: defaultURIOptions}
+
+	// Options, after the last "?": the source may have a query
+	if idx := strings.LastIndex(rest, "?"); idx != -1 {
+		if err := uri.Options.parse(rest[idx+1:]); err != nil {
+			if strings.Contains(rest[:idx], "@http") {
+				return nil, fmt.Errorf("invalid chart URI %q: %v (the query of an archive URL must be followed by \"?\")", raw, err)
+			}
+			return nil, fmt.Errorf("invalid chart URI %q: %v", raw, err)
+		}
+		rest = rest[:idx]
+	}
+
+	// Source
+	if idx := strings.Index(rest, "@"); idx != -1 {
+		source, err := parseChartSource(rest[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart URI %q: %v", raw, err)
+		}
+		uri.Source = source
+		rest = rest[:idx]
+	}
+
+	// Files
+	for _, file := range strings.Split(rest, ",") {
+		file, err := url.PathUnescape(strings.TrimSpace(file))
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart URI %q: bad file name encoding: %v", raw, err)
+		}
+		if file == "" {
+			continue
+		}
+		if isGlobPattern(file) {
+			if err := checkGlobPattern(file); err != nil {
+				return nil, fmt.Errorf("invalid chart URI %q: %v", raw, err)
+			}
+		}
+		uri.Files = append(uri.Files, file)
+	}
+	if len(uri.Files) == 0 {
+		return nil, fmt.Errorf("invalid chart URI %q: no file given. Expected %svalues.yaml[,values-env.yaml...][@repo/chart[:version]]", raw, chartScheme)
+	}
+
+	return uri, nil
+}
+
+func parseChartSource(raw string) (*ChartSource, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("empty chart after @. Expected repo/chart[:version]")
+	}
+	if strings.HasPrefix(raw, ociScheme) {
+		return parseOCISource(raw)
+	}
+	if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+		return parseURLSource(raw)
+	}
+
+	source := &ChartSource{Chart: raw}
+	if idx := strings.Index(raw, ":"); idx != -1 {
+		source.Chart = raw[:idx]
+		source.Version = raw[idx+1:]
+		if source.Version == "" {
+			return nil, fmt.Errorf("empty version in %q. Expected repo/chart[:version]", raw)
+		}
+		if strings.Contains(source.Version, ":") {
+			return nil, fmt.Errorf("too many \":\" in %q. Expected repo/chart[:version]", raw)
+		}
+	}
+
+	parts := strings.Split(source.Chart, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid chart %q. Expected repo/chart[:version]", source.Chart)
+	}
+
+	return source, nil
+}
+
+// parseOCISource parses oci://registry[:port]/path/name[:version][@digest]
+func parseOCISource(raw string) (*ChartSource, error) {
+	const expected = "Expected oci://registry/path/chart[:version][@digest]"
+
+	ref := raw
+	source := &ChartSource{}
+
+	if idx := strings.LastIndex(ref, "@"); idx != -1 {
+		source.Digest = ref[idx+1:]
+		ref = ref[:idx]
+		if !digestRegexp.MatchString(source.Digest) {
+			return nil, fmt.Errorf("invalid digest %q in %q. %s", source.Digest, raw, expected)
+		}
+	}
+
+	// The version is after the last "/", a ":" before is the port of the registry
+	slash := strings.LastIndex(ref, "/")
+	if slash < len(ociScheme) {
+		return nil, fmt.Errorf("no chart path in %q. %s", raw, expected)
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > slash {
+		source.Version = ref[idx+1:]
+		ref = ref[:idx]
+		if source.Version == "" {
+			return nil, fmt.Errorf("empty version in %q. %s", raw, expected)
+		}
+	}
+
+	registry := strings.TrimPrefix(ref, ociScheme)
+	for _, part := range strings.Split(registry, "/") {
+		if part == "" {
+			return nil, fmt.Errorf("invalid chart %q. %s", ref, expected)
+		}
+	}
+
+	source.Chart = ref
+	return source, nil
+}
+
+// parseURLSource parses an archive URL (https://host/path/chart-1.0.0.tgz) or
+// a repository URL followed by a chart (https://host/path//chart[:version])
+func parseURLSource(raw string) (*ChartSource, error) {
+	const expected = "Expected https://host/path/chart-version.tgz or https://host/path//chart[:version]"
+
+	scheme := raw[:strings.Index(raw, "://")+3]
+	rest := strings.TrimPrefix(raw, scheme)
+
+	idx := strings.Index(rest, "//")
+	if idx == -1 {
+		// Archive URL, maybe with a query
+		archiveURL, err := url.ParseRequestURI(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL %q: %v. %s", raw, err, expected)
+		}
+		if !hasTgzExtension(archiveURL.Path) {
+			return nil, fmt.Errorf("%q is neither a chart archive nor a repository followed by a chart. %s", raw, expected)
+		}
+		return &ChartSource{Chart: raw}, nil
+	}
+
+	// Repository URL and chart
+	source := &ChartSource{
+		Repo:  scheme + rest[:idx],
+		Chart: rest[idx+2:],
+	}
+	if idx := strings.Index(source.Chart, ":"); idx != -1 {
+		source.Version = source.Chart[idx+1:]
+		source.Chart = source.Chart[:idx]
+		if source.Version == "" {
+			return nil, fmt.Errorf("empty version in %q. %s", raw, expected)
+		}
+	}
+	if source.Chart == "" || strings.Contains(source.Chart, "/") {
+		return nil, fmt.Errorf("invalid chart %q in %q. %s", source.Chart, raw, expected)
+	}
+	if _, err := url.ParseRequestURI(source.Repo); err != nil || strings.TrimPrefix(source.Repo, scheme) == "" {
+		return nil, fmt.Errorf("invalid repository URL %q. %s", source.Repo, expected)
+	}
+
+	return source, nil
+}
+
+func (o *URIOptions) parse(rawQuery string) error {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("bad options: %v", err)
+	}
+
+	for key, values := range query {
+		if len(values) != 1 {
+			return fmt.Errorf("option %s given %d times", key, len(values))
+		}
+		value := values[0]
+
+		switch key {
+		case "subcharts":
+			o.Subcharts, err = parseBoolOption(key, value)
+		case "strict":
+			o.Strict, err = parseBoolOption(key, value)
+		case "env":
+			o.Env, err = parseBoolOption(key, value)
+		case "render":
+			o.Render, err = parseBoolOption(key, value)
+		case "preserve":
+			o.Preserve, err = parseBoolOption(key, value)
+		case "validate":
+			o.Validate, err = parseBoolOption(key, value)
+		case "verify":
+			o.Verify, err = parseBoolOption(key, value)
+		case "offline":
+			o.Offline, err = parseBoolOption(key, value)
+		case "doc":
+			if value == "" {
+				err = fmt.Errorf("option doc must be an index or a name")
+			}
+			o.Doc = value
+		case "format":
+			o.Format, err = parseEnumOption(key, value, inputFormats)
+		case "output":
+			o.Output, err = parseEnumOption(key, value, outputFormats)
+		case "indent":
+			o.Indent, err = parseIntOption(key, value, 0, 9)
+		case "width":
+			o.Width, err = parseIntOption(key, value, 0, 1000)
+		case "disabled":
+			o.Disabled, err = parseEnumOption(key, value, disabledModes)
+		default:
+			err = fmt.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.Preserve && o.Output != "yaml" {
+		return fmt.Errorf("option preserve needs output=yaml")
+	}
+	if o.Indent >= 0 && o.Indent < 2 && o.Output == "yaml" {
+		return fmt.Errorf("option indent must be from 2 to 9 with output=yaml")
+	}
+	if o.Indent >= 0 && o.Output == "env" {
+		return fmt.Errorf("option indent cannot be used with output=env")
+	}
+	return nil
+}
+
+func parseBoolOption(key string, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("option %s must be true or false, not %q", key, value)
+	}
+	return b, nil
+}
+
+func parseIntOption(key string, value string, min int, max int) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < min || i > max {
+		return 0, fmt.Errorf("option %s must be a number from %d to %d, not %q", key, min, max, value)
+	}
+	return i, nil
+}
+
+func parseEnumOption(key string, value string, allowed []string) (string, error) {
+	for _, a := range allowed {
+		if value == a {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("option %s must be one of %s, not %q", key, strings.Join(allowed, ", "), value)
+}
+
+// String returns the canonical form of the URI: file names encoded, options
+// sorted and options with their default value left out. Two URIs giving the
+// same values have the same canonical form.
+func (u *ChartURI) String() string {
+	var sb strings.Builder
+	sb.WriteString(chartScheme)
+
+	for i, file := range u.Files {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(escapeURIFile(file))
+	}
+
+	if u.Source != nil {
+		sb.WriteString("@")
+		sb.WriteString(u.Source.String())
+	}
+
+	// The "?" closes the query of an archive URL, even without options
+	if query := u.Options.String(); query != "" || (u.Source != nil && strings.Contains(u.Source.String(), "?")) {
+		sb.WriteString("?")
+		sb.WriteString(query)
+	}
+
+	return sb.String()
+}
+
+func (s *ChartSource) String() string {
+	ref := s.Chart
+	if s.Repo != "" {
+		ref = strings.TrimSuffix(s.Repo, "/") + "//" + s.Chart
+	}
+	if s.Version != "" {
+		ref += ":" + s.Version
+	}
+	if s.Digest != "" {
+		ref += "@" + s.Digest
+	}
+	return ref
+}
+
+// IsOCI tells if the chart is stored in an OCI registry
+func (s *ChartSource) IsOCI() bool {
+	return strings.HasPrefix(s.Chart, ociScheme)
+}
+
+// IsArchive tells if the chart is given by the URL of its archive
+func (s *ChartSource) IsArchive() bool {
+	return s.Repo == "" && (strings.HasPrefix(s.Chart, "http://") || strings.HasPrefix(s.Chart, "https://"))
+}
+
+// Name returns the name of the chart, without its repository
+func (s *ChartSource) Name() string {
+	if s.IsArchive() {
+		// https://host/path/chart-1.0.0.tgz[?query]
+		archivePath := s.Chart
+		if u, err := url.Parse(s.Chart); err == nil {
+			archivePath = u.Path
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(path.Base(archivePath), ".tgz"), ".tar.gz")
+		return archiveVersionRegexp.ReplaceAllString(name, "")
+	}
+	return path.Base(s.Chart)
+}
+
+var archiveVersionRegexp = regexp.MustCompile(`-v?[0-9]+\.[0-9]+\.[0-9]+.*$`)
+
+// String returns the options which are not set to their default value, sorted by name
+func (o URIOptions) String() string {
+	options := map[string]string{}
+	if o.Subcharts != defaultURIOptions.Subcharts {
+		options["subcharts"] = strconv.FormatBool(o.Subcharts)
+	}
+	if o.Strict != defaultURIOptions.Strict {
+		options["strict"] = strconv.FormatBool(o.Strict)
+	}
+	if o.Env != defaultURIOptions.Env {
+		options["env"] = strconv.FormatBool(o.Env)
+	}
+	if o.Render != defaultURIOptions.Render {
+		options["render"] = strconv.FormatBool(o.Render)
+	}
+	if o.Doc != defaultURIOptions.Doc {
+		options["doc"] = o.Doc
+	}
+	if o.Preserve != defaultURIOptions.Preserve {
+		options["preserve"] = strconv.FormatBool(o.Preserve)
+	}
+	if o.Validate != defaultURIOptions.Validate {
+		options["validate"] = strconv.FormatBool(o.Validate)
+	}
+	if o.Verify != defaultURIOptions.Verify {
+		options["verify"] = strconv.FormatBool(o.Verify)
+	}
+	if o.Offline != defaultURIOptions.Offline {
+		options["offline"] = strconv.FormatBool(o.Offline)
+	}
+	if o.Format != defaultURIOptions.Format {
+		options["format"] = o.Format
+	}
+	if o.Output != defaultURIOptions.Output {
+		options["output"] = o.Output
+	}
+	if o.Indent != defaultURIOptions.Indent {
+		options["indent"] = strconv.Itoa(o.Indent)
+	}
+	if o.Width != defaultURIOptions.Width {
+		options["width"] = strconv.Itoa(o.Width)
+	}
+	if o.Disabled != defaultURIOptions.Disabled {
+		options["disabled"] = o.Disabled
+	}
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+url.QueryEscape(options[key]))
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapeURIFile encodes the characters of a file name which have a meaning in a chart:// URI
+func escapeURIFile(file string) string {
+	replacer := strings.NewReplacer("%", "%25", ",", "%2C", "@", "%40", "?", "%3F")
+	return replacer.Replace(file)
+}
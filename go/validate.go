@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaFile is the JSON schema of the values of a chart
+const schemaFile = "values.schema.json"
+
+// chartSchema is the schema of a chart of the tree, with the defaults it is validated with
+type chartSchema struct {
+	// path of the schema file, empty if the chart has none
+	path   string
+	schema []byte
+	// name of the chart, for the messages
+	name string
+	// prefix is the path of the values of the chart in the aggregated values
+	prefix   []string
+	defaults map[string]interface{}
+}
+
+// valuesOrigin is a file found in a chart, telling where the values of the aggregated values
+// come from
+type valuesOrigin struct {
+	file string
+	// chart is the path of the chart in the values, empty for the top chart
+	chart string
+	// pointers are the JSON pointers of the values of the file in the aggregated values
+	pointers map[string]bool
+	// rank of the file in the merge order, as the sources of the preserved values
+	layer, rank, index int
+}
+
+// loadChartSchema reads the values.schema.json and the values.yaml of a chart
+func loadChartSchema(chart *chartFS, metadata *ChartMetadata, prefix []string, ctx *searchContext) *chartSchema {
+	schema := &chartSchema{
+		name:     chart.name(),
+		prefix:   prefix,
+		defaults: loadChartDefaults(chart),
+	}
+	if metadata != nil && metadata.Name != "" {
+		schema.name = metadata.Name
+	}
+
+	path := chart.filePath(schemaFile)
+	content, err := chart.readFile(schemaFile)
+	if os.IsNotExist(err) {
+		Fdebug("No %s in %s", schemaFile, chart)
+		return schema
+	}
+	if err != nil {
+		ctx.fail("Failed to read %s: %v", path, err)
+		return schema
+	}
+	schema.path = path
+	schema.schema = content
+	return schema
+}
+
+// addOrigins records the files and the schema of a chart, once its values are merged.
+// The files take the rank given to the chart by addSources. schema is nil for the
+// disabled charts.
+func (c *searchContext) addOrigins(origins []*valuesOrigin, schema *chartSchema) {
+	for _, origin := range origins {
+		origin.rank = c.chartOrder
+		c.origins = append(c.origins, origin)
+	}
+	if schema != nil {
+		c.schemas = append(c.schemas, schema)
+	}
+}
+
+// valuePointers gives the JSON pointers of the values of a file in the aggregated values.
+// Global values and tags are shared by all the charts.
+func valuePointers(values map[string]interface{}, prefix []string) map[string]bool {
+	pointers := make(map[string]bool)
+	for key, value := range values {
+		path := append(append([]string{}, prefix...), key)
+		if key == "global" || key == "tags" {
+			path = []string{key}
+		}
+		addValuePointers(pointers, path, value)
+	}
+	return pointers
+}
+
+func addValuePointers(pointers map[string]bool, path []string, value interface{}) {
+	pointers[jsonPointer(path)] = true
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, v := range m {
+			addValuePointers(pointers, append(path[:len(path):len(path)], key), v)
+		}
+	}
+}
+
+// jsonPointer writes a path as a JSON pointer (RFC 6901)
+func jsonPointer(path []string) string {
+	replacer := strings.NewReplacer("~", "~0", "/", "~1")
+	var sb strings.Builder
+	for _, key := range path {
+		sb.WriteString("/")
+		sb.WriteString(replacer.Replace(key))
+	}
+	return sb.String()
+}
+
+// validateValues checks the aggregated values against the values.schema.json of the charts,
+// as helm does at install: the values of the top chart against its schema, and the values
+// of each sub-chart, with the global values, against the schema of the sub-chart.
+// Helm validates the values merged with the defaults of the charts, so the values are
+// validated over the values.yaml of the charts, the defaults of a chart overriding the
+// defaults of its sub-charts.
+// Each value not matching a schema is reported with its JSON pointer and the file it comes from.
+func validateValues(values map[string]interface{}, ctx *searchContext) error {
+	merged := make(map[string]interface{})
+	for _, schema := range ctx.schemas {
+		defaults := copyValues(schema.defaults)
+		if globals, ok := defaults["global"].(map[string]interface{}); ok {
+			mergeMaps(merged, map[string]interface{}{"global": globals})
+		}
+		delete(defaults, "global")
+		mergeMaps(valuesAt(merged, schema.prefix), defaults)
+	}
+	mergeMaps(merged, values)
+	deleteNullValues(merged)
+
+	origins := append([]*valuesOrigin{}, ctx.origins...)
+	sort.SliceStable(origins, func(i, j int) bool {
+		a, b := origins[i], origins[j]
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		return a.index < b.index
+	})
+
+	var errs []string
+	for _, schema := range ctx.schemas {
+		if schema.schema == nil {
+			continue
+		}
+		Fdebug("Validating the values of %s against %s", schema.name, schema.path)
+
+		compiled, err := compileSchema(schema)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid schema %s: %v", schema.path, err))
+			continue
+		}
+
+		chartValues := valuesAt(merged, schema.prefix)
+		if len(schema.prefix) > 0 {
+			// The sub-charts see the global values
+			chartValues = copyValues(chartValues)
+			if globals, ok := merged["global"]; ok {
+				chartValues["global"] = globals
+			}
+		}
+
+		err = compiled.Validate(chartValues)
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("cannot validate the values of %s: %v", schema.name, err))
+			}
+			continue
+		}
+		for _, cause := range leafErrors(validationErr) {
+			pointer := cause.InstanceLocation
+			if !strings.HasPrefix(pointer, "/global/") && pointer != "/global" {
+				pointer = jsonPointer(schema.prefix) + pointer
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s (schema of %s, %s)", pointerOrRoot(pointer), cause.Message, schema.name, valueOrigin(origins, pointer)))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("values do not match the schemas of the charts:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// valuesAt returns the map at a path of the values, created if it is missing
+func valuesAt(values map[string]interface{}, path []string) map[string]interface{} {
+	for _, key := range path {
+		m, ok := values[key].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			values[key] = m
+		}
+		values = m
+	}
+	return values
+}
+
+func compileSchema(schema *chartSchema) (*jsonschema.Schema, error) {
+	path, err := filepath.Abs(schema.path)
+	if err != nil {
+		return nil, err
+	}
+	url := "file://" + filepath.ToSlash(path)
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(schema.schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+// leafErrors returns the errors of a validation error which have no cause
+func leafErrors(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, leafErrors(cause)...)
+	}
+	return leaves
+}
+
+// valueOrigin tells which file gives the value at a pointer: the last file in the merge
+// order giving it, or else giving its closest parent
+func valueOrigin(origins []*valuesOrigin, pointer string) string {
+	for p := pointer; p != ""; p = p[:strings.LastIndex(p, "/")] {
+		for i := len(origins) - 1; i >= 0; i-- {
+			if origins[i].pointers[p] {
+				if origins[i].chart == "" {
+					return "from " + origins[i].file
+				}
+				return fmt.Sprintf("from %s of sub-chart %s", origins[i].file, origins[i].chart)
+			}
+		}
+	}
+	return "not given by the files"
+}
+
+func pointerOrRoot(pointer string) string {
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
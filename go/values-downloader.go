@@ -1,14 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"runtime"
 	"strings"
 
-	"dario.cat/mergo"
-	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,40 +19,90 @@ import (
 // 	}
 // }
 
-func getChart(helmCmd string) (chart, chartVersion, chartRepo string) {
+// HelmCommand is what the plugin uses of the parent helm command line
+type HelmCommand struct {
+	Chart   string
+	Version string
+	Repo    string
+	// Release is the name of the release, empty with --generate-name
+	Release string
+	// Namespace given with -n or --namespace, empty if not given
+	Namespace string
+	// Devel is set by --devel: pre-release versions are used too
+	Devel bool
+	// DependencyUpdate is set by --dependency-update: dependencies are updated before installing
+	DependencyUpdate bool
+	// Verify is set by --verify: the chart is verified before it is used
+	Verify bool
+	// Keyring given with --keyring, to verify the charts
+	Keyring string
+	// TLS files given by helm to the downloader (--cert-file, --key-file, --ca-file),
+	// to download the charts
+	TLS tlsFiles
+}
+
+// helmFlagsWithValue are the flags of helm install, upgrade and template followed by a value,
+// which must not be taken for the release or the chart
+var helmFlagsWithValue = map[string]bool{
+	"-f": true, "--values": true,
+	"--set": true, "--set-string": true, "--set-file": true, "--set-json": true, "--set-literal": true,
+	"-n": true, "--namespace": true,
+	"--version": true, "--repo": true,
+	"--username": true, "--password": true, "--ca-file": true, "--cert-file": true, "--key-file": true,
+	"--keyring": true, "--description": true, "--name-template": true, "--timeout": true,
+	"--post-renderer": true, "--post-renderer-args": true, "-l": true, "--labels": true,
+	"-o": true, "--output": true, "--output-dir": true, "-s": true, "--show-only": true,
+	"-a": true, "--api-versions": true, "--kube-version": true, "--history-max": true,
+	"--kube-context": true, "--kubeconfig": true, "--kube-apiserver": true, "--kube-as-user": true,
+	"--kube-as-group": true, "--kube-token": true, "--kube-ca-file": true, "--kube-tls-server-name": true,
+	"--registry-config": true, "--repository-cache": true, "--repository-config": true,
+	"--burst-limit": true, "--qps": true,
+}
+
+// getChart parses the parent helm command line: helm <command> [release] <chart> [flags].
+// The chart is the last positional argument, and the release the one before it.
+func getChart(helmCmd string) (cmd HelmCommand) {
 	args := parseHelmCmdArgs(helmCmd)
-	var sawChartVersion, sawChartRepo bool
+	var positionals []string
 
 	for i := 0; i < len(args); i++ {
 		opt := args[i]
-		switch {
-		case opt == "--version":
-			sawChartVersion = true
-		case len(opt) > 9 && opt[:9] == "--version":
-			// --version=XXX
-			if eqIdx := indexOf(opt, '='); eqIdx != -1 {
-				chartVersion = opt[eqIdx+1:]
-			}
-		case opt == "--repo":
-			sawChartRepo = true
-		case len(opt) > 6 && opt[:6] == "--repo=":
-			// --repo=XXX
-			if eqIdx := indexOf(opt, '='); eqIdx != -1 {
-				chartRepo = opt[eqIdx+1:]
-			}
-		case len(opt) > 1 && opt[:2] == "--":
-			// skip other flags
-		default:
-			if sawChartVersion {
-				chartVersion = opt
-				sawChartVersion = false
-			} else if sawChartRepo {
-				chartRepo = opt
-				sawChartRepo = false
-			} else {
-				chart = opt
-			}
+		if len(opt) < 2 || opt[0] != '-' {
+			positionals = append(positionals, opt)
+			continue
 		}
+
+		// --flag=value or --flag value
+		name, value, hasValue := strings.Cut(opt, "=")
+		if !hasValue && helmFlagsWithValue[name] && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "--version":
+			cmd.Version = value
+		case "--repo":
+			cmd.Repo = value
+		case "-n", "--namespace":
+			cmd.Namespace = value
+		case "--devel":
+			cmd.Devel = value != "false"
+		case "--dependency-update":
+			cmd.DependencyUpdate = value != "false"
+		case "--verify":
+			cmd.Verify = value != "false"
+		case "--keyring":
+			cmd.Keyring = value
+		}
+	}
+
+	// helm, the command, then the release and the chart
+	if len(positionals) > 0 {
+		cmd.Chart = positionals[len(positionals)-1]
+	}
+	if len(positionals) > 3 {
+		cmd.Release = positionals[len(positionals)-2]
 	}
 	return
 }
@@ -94,250 +142,511 @@ func parseHelmCmdArgs(cmd string) []string {
 	return args
 }
 
-// Helper: returns index of first '=' or -1
-func indexOf(s string, ch byte) int {
-	for i := 0; i < len(s); i++ {
-		if s[i] == ch {
-			return i
-		}
+// getLocal reads the values of a local chart: a folder, or an archive
+func getLocal(helmCmd *HelmCommand, uri *ChartURI, cache *chartCache) error {
+	Fdebug("Called getLocal with chart=%s, valueFiles=%v", helmCmd.Chart, uri.Files)
+	info, err := os.Stat(helmCmd.Chart)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return PrintValues(diskChart(helmCmd.Chart), uri, helmCmd, cache, nil)
 	}
-	return -1
-}
 
-func getLocal(chart string, valueFile string, tmpDir string) {
-	Fdebug("Called getLocal with chart=%s, valueFile=%s", chart, valueFile)
-	PrintValues(chart, valueFile, chart, tmpDir)
+	// The archive is read once, so that the chart is read from the bytes verified
+	content, err := os.ReadFile(helmCmd.Chart)
+	if err != nil {
+		return err
+	}
+	if verifier := newChartVerifier(uri.Options, helmCmd); verifier != nil {
+		if err := verifier.verifyProvenance(helmCmd.Chart, content); err != nil {
+			return fmt.Errorf("chart %s is not verified: %v", helmCmd.Chart, err)
+		}
+		Finfo("Chart %s verified", helmCmd.Chart)
+	}
+	chart, err := contentChart(content, helmCmd.Chart, archiveFilter(uri.Files))
+	if err != nil {
+		return err
+	}
+	return PrintValues(chart, uri, helmCmd, cache, nil)
 }
 
-func getRemote(chart string, valueFile string, chartVersion string, chartRepo string, tmpDir string) {
-	Fdebug("Called getRemote with chart=%s, valueFile=%s, chartVersion=%s, chartRepo=%s", chart, valueFile, chartVersion, chartRepo)
+func getRemote(source *ChartSource, uri *ChartURI, helmCmd *HelmCommand, cache *chartCache) error {
+	Fdebug("Called getRemote with chart=%s, valueFiles=%v, chartVersion=%s, chartRepo=%s", source.Chart, uri.Files, source.Version, source.Repo)
 
-	helm := os.Getenv("HELM_BIN")
-	if helm == "" {
-		helm = "helm"
+	// Pin the version, so that the values come from the chart helm installs.
+	// --devel only applies to the chart being installed
+	resolved, err := resolveChartVersion(source, uri.Source == nil && helmCmd.Devel)
+	if err != nil {
+		return err
 	}
-
-	var args []string
-	args = append(args, "pull")
-	args = append(args, chart)
-	if chartRepo != "" {
-		args = append(args, "--repo", chartRepo)
+	var resolvedSource *ChartSource
+	if resolved {
+		Finfo("Using chart %s", source)
+		resolvedSource = source
 	}
-	if chartVersion != "" {
-		args = append(args, "--version", chartVersion)
+
+	chart, err := pullChart(source, helmCmd.TLS, newChartVerifier(uri.Options, helmCmd), cache, archiveFilter(uri.Files))
+	if err != nil {
+		return err
 	}
 
-	id := uuid.New().String()
+	return PrintValues(chart, uri, helmCmd, cache, resolvedSource)
+}
 
-	args = append(args, "--debug", "--untar", "--destination", tmpDir, "--untardir", id)
+// valuesLayer holds the values aggregated for one of the requested files.
+// Each file of a chart://a.yaml,b.yaml URI gets its own layer so that the
+// layers can be merged in order once the whole chart tree has been visited.
+type valuesLayer struct {
+	globalMap map[string]interface{}
+	localMap  map[string]interface{}
+	tagMap    map[string]interface{}
+}
+
+func newValuesLayers(count int) []valuesLayer {
+	layers := make([]valuesLayer, count)
+	for i := range layers {
+		layers[i] = valuesLayer{
+			globalMap: make(map[string]interface{}),
+			localMap:  make(map[string]interface{}),
+			tagMap:    make(map[string]interface{}),
+		}
+	}
+	return layers
+}
 
-	cmd := exec.Command(helm, args...)
+// searchContext holds what stays the same during the whole search in a chart tree
+type searchContext struct {
+	valueFiles []string
+	options    URIOptions
+	// cache of the charts pulled
+	cache *chartCache
+	// keep tells which files of the archives are read
+	keep func(name string) bool
+	// found tells, for each value file, if it was found in at least one chart
+	found []bool
+	// errors met during the search, only fatal in strict mode
+	errors []error
+	// tags of the top chart, enabling or disabling dependencies
+	tags map[string]interface{}
+	// dependencyUpdate is set when the dependencies of the chart being installed are updated by helm
+	dependencyUpdate bool
+	// fetched holds the dependencies pulled from their repository
+	fetched map[string]*subchart
+	// release being installed, for the values files rendered as templates
+	release renderRelease
+	// sources are the files found, kept to preserve their layout in the output
+	sources []*valuesSource
+	// chartOrder counts the charts whose values are merged
+	chartOrder int
+	// loadedSources counts the files read
+	loadedSources int
+	// origins are the files found, to tell where the values not matching a schema come from
+	origins []*valuesOrigin
+	// schemas of the charts searched, sub-charts first
+	schemas []*chartSchema
+	// verifier of the sub-chart archives and the dependencies pulled, nil if they are not verified
+	verifier *chartVerifier
+	// refused are the charts which could not be verified and the files which could not
+	// be decrypted, always fatal
+	refused []error
+	// tls are the files given by helm to download the dependencies
+	tls tlsFiles
+	// documents are the elements of the doc option matching a document of the files read
+	documents map[string]bool
+}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func newSearchContext(uri *ChartURI, helmCmd *HelmCommand, cache *chartCache) *searchContext {
+	ctx := &searchContext{
+		valueFiles:       uri.Files,
+		options:          uri.Options,
+		cache:            cache,
+		keep:             archiveFilter(uri.Files),
+		found:            make([]bool, len(uri.Files)),
+		dependencyUpdate: uri.Source == nil && helmCmd != nil && helmCmd.DependencyUpdate,
+		fetched:          make(map[string]*subchart),
+		release:          newRenderRelease(helmCmd),
+		verifier:         newChartVerifier(uri.Options, helmCmd),
+		documents:        make(map[string]bool),
+	}
+	if helmCmd != nil {
+		ctx.tls = helmCmd.TLS
+	}
+	return ctx
+}
 
-	err := cmd.Run()
-	if err != nil {
-		Ferror("Erreur: %v", err)
-		return
+// fail reports an error met during the search. In strict mode, the error is
+// kept to stop once the search is over. Otherwise it is just a warning.
+func (c *searchContext) fail(format string, args ...interface{}) {
+	if c.options.Strict {
+		c.errors = append(c.errors, fmt.Errorf(format, args...))
+	} else {
+		Fwarn(format, args...)
 	}
+}
 
-	// If chart is repo/chartname we need to extract the chart name
-	if strings.Contains(chart, "/") {
-		parts := strings.Split(chart, "/")
-		if len(parts) > 0 {
-			chart = parts[len(parts)-1]
+// refuse reports a chart which cannot be verified or a file which cannot be decrypted:
+// its values are not used, and the search fails once it is over, even without strict
+func (c *searchContext) refuse(format string, args ...interface{}) {
+	c.refused = append(c.refused, fmt.Errorf(format, args...))
+}
+
+// err returns the errors met during the search which must stop the plugin
+func (c *searchContext) err() error {
+	if !c.options.Strict {
+		return errors.Join(c.refused...)
+	}
+	errs := append(c.refused, c.errors...)
+	for i, found := range c.found {
+		if !found {
+			errs = append(errs, fmt.Errorf("file %s not found in the chart", c.valueFiles[i]))
 		}
 	}
+	return errors.Join(errs...)
+}
 
-	extractedFolder := tmpDir + string(os.PathSeparator) + id + string(os.PathSeparator) + chart
-	PrintValues(extractedFolder, valueFile, extractedFolder, tmpDir)
+// subLayers returns the layers seen from the sub-chart "name": the local values
+// are nested under the sub-chart key, global values and tags are shared.
+// It also tells in which layers the map of the sub-chart was created: this map is only
+// scaffolding, removed by pruneSubLayers if nothing is found in the sub-chart.
+func subLayers(layers []valuesLayer, name string) ([]valuesLayer, []bool) {
+	sub := make([]valuesLayer, len(layers))
+	scaffolded := make([]bool, len(layers))
+	for i, layer := range layers {
+		localMap, exists := layer.localMap[name].(map[string]interface{})
+		if !exists {
+			localMap = make(map[string]interface{})
+			layer.localMap[name] = localMap
+			scaffolded[i] = true
+		}
+		sub[i] = valuesLayer{
+			globalMap: layer.globalMap,
+			localMap:  localMap,
+			tagMap:    layer.tagMap,
+		}
+	}
+	return sub, scaffolded
 }
 
-// Helper function to merge two maps, with src overriding dest
-func mergeMaps(dest, src map[string]interface{}) {
-	mergo.Merge(&dest, src, mergo.WithOverride)
+// pruneSubLayers removes the maps created by subLayers which are still empty. Empty maps
+// written in the files are kept: as in helm, {} is a value.
+func pruneSubLayers(layers []valuesLayer, name string, scaffolded []bool) {
+	for i, layer := range layers {
+		if localMap, ok := layer.localMap[name].(map[string]interface{}); ok && scaffolded[i] && len(localMap) == 0 {
+			delete(layer.localMap, name)
+		}
+	}
 }
 
 /**
  * Recursive function to search for values files in a chart directory.
- * It traverses the directory structure and merges global values from found files into globalMap,
- * and the other values in localMap
+ * It traverses the directory structure and, for each requested file, merges global values
+ * from found files into the globalMap of the matching layer, and the other values in its localMap.
+ * inherited holds the values given to the chart by its parents, used with the values of the chart
+ * to evaluate the conditions of its dependencies.
+ * enabled is false for the charts disabled by their condition or tags, or by a parent, searched
+ * with disabled=include: helm leaves them out, so their schemas are not validated.
  */
-func searchInChart(chartDir, prefix string, valueFile string,
-	globalMap map[string]interface{},
-	localMap map[string]interface{},
-	tagMap map[string]interface{},
-	tmpDir string) {
+func searchInChart(chartDir *chartFS, prefix string,
+	layers []valuesLayer,
+	inherited map[string]interface{},
+	enabled bool,
+	ctx *searchContext) {
 
 	Fdebug("Searching in chart directory: %s with prefix: %s", chartDir, prefix)
 
-	chartsDir := chartDir + string(os.PathSeparator) + "charts"
-	info, err := os.Stat(chartsDir)
-
-	// No chart directory found, we are at the deepest level
-	if err == nil && info.IsDir() {
-		entries, err := os.ReadDir(chartsDir)
-		if err != nil {
-			LogError(fmt.Sprintf("Failed to read directory %s: %v", chartsDir, err))
-		}
-		for _, entry := range entries {
-			if entry.IsDir() {
-				// The entry is a directory, we assume it is a sub-chart
-				// Recursively search in subdirectories
-				_, exists := localMap[entry.Name()]
-				if !exists {
-					localMap[entry.Name()] = make(map[string]interface{})
-				}
-				searchInChart(chartsDir+string(os.PathSeparator)+entry.Name(), entry.Name(), valueFile,
-					globalMap,
-					localMap[entry.Name()].(map[string]interface{}),
-					tagMap,
-					tmpDir)
-			} else {
-				tgzPath := chartsDir + string(os.PathSeparator) + entry.Name()
-				tgz, err := IsTgzFile(tgzPath)
-				if err != nil {
-					Fwarn("Error checking if %s is a tgz file: %v", entry.Name(), err)
-					continue
-				}
-				if !tgz {
-					Fdebug("Skipping non-tgz file: %s", entry.Name())
-					continue
-				}
-				Fdebug("Found tgz file: %s", entry.Name())
+	metadata, err := loadChartMetadata(chartDir)
+	if err != nil {
+		Fdebug("Cannot read Chart.yaml of %s, sub-charts are keyed by their name: %v", chartDir, err)
+	}
 
-				id := uuid.New().String()
-				tmpDirTgz := tmpDir + string(os.PathSeparator) + id
+	render := &renderContext{Release: ctx.release, Chart: metadata, Subchart: prefix}
+	if render.Chart == nil {
+		render.Chart = &ChartMetadata{}
+	}
 
-				// We found a tgz file, we extract it to a temporary directory
-				err = ExtractTgz(tgzPath, tmpDirTgz)
-				if err != nil {
-					Fwarn("Failed to extract tgz file %s: %v", tgzPath, err)
-					continue
-				}
-				Fdebug("Extracted tgz file %s to %s", tgzPath, tmpDirTgz)
+	config, err := loadChartConfig(chartDir)
+	if err != nil {
+		ctx.fail("Cannot read %s of %s: %v", listStrategiesFile, chartDir, err)
+	}
 
-				// The extracted directory should containt 1 single directory with the subchart name
-				subentries, err := os.ReadDir(tmpDirTgz)
+	// Values of the files of the chart itself, for each layer.
+	// They are read first to enable or disable the dependencies, but merged last:
+	// the values of a chart override the values of its dependencies
+	chartValues := make([]map[string]interface{}, len(layers))
+	var sources []*valuesSource
+	var origins []*valuesOrigin
+	var path []string
+	if prefix != "" {
+		path = strings.Split(prefix, ".")
+	}
+	addSources := func(layer int, valueFile string, values map[string]interface{}, nodes []*yaml.Node) {
+		if ctx.options.Validate {
+			origins = append(origins, &valuesOrigin{file: valueFile, chart: prefix, pointers: valuePointers(values, path), layer: layer, index: len(origins)})
+		}
+		if !ctx.options.Preserve {
+			return
+		}
+		for _, node := range nodes {
+			ctx.loadedSources++
+			sources = append(sources, &valuesSource{root: node, prefix: path, layer: layer, file: len(sources), loaded: ctx.loadedSources})
+		}
+	}
+	for i, valueFile := range ctx.valueFiles {
+		chartValues[i] = make(map[string]interface{})
+
+		if !isGlobPattern(valueFile) {
+			if values, nodes, found := loadValuesFile(chartDir, valueFile, render, config, ctx); found {
+				ctx.found[i] = true
+				addSources(i, valueFile, values, nodes)
+				mergeMaps(chartValues[i], values)
+			}
+			continue
+		}
 
-				if err != nil {
-					Ferror("Error reading extracted folder: %v", err)
-					continue
-				}
+		// The file is a pattern: merge all the matching files of the chart in lexical order
+		matches, err := globChartFiles(chartDir, valueFile)
+		if err != nil {
+			ctx.fail("Error searching %s in %s: %v", valueFile, chartDir, err)
+			continue
+		}
+		Fdebug("Pattern %s matches %v in %s", valueFile, matches, chartDir)
+		for _, match := range matches {
+			if values, nodes, found := loadValuesFile(chartDir, match, render, config, ctx); found {
+				ctx.found[i] = true
+				addSources(i, match, values, nodes)
+				mergeMaps(chartValues[i], values)
+			}
+		}
+	}
 
-				// Vérifier qu'il y a exactement un élément
-				if len(subentries) != 1 {
-					Fwarn("Subchart %s does not contain 1 element. Incorrect helm structure for helm chart", entry.Name())
-					continue
-				}
+	if !ctx.options.Subcharts {
+		Fdebug("Sub-charts of %s are not searched", chartDir)
+	} else {
+		view := chartView(chartDir, chartValues, inherited)
+		if prefix == "" {
+			// Only the tags of the top chart enable dependencies
+			ctx.tags, _ = view["tags"].(map[string]interface{})
+		}
 
-				// Vérifier que c'est un répertoire
-				if !subentries[0].IsDir() {
-					Fwarn("Subchart %s does not contain 1 folder. Incorrect helm structure for helm chart", entry.Name())
+		subcharts := loadSubcharts(chartDir.sub("charts"), ctx)
+		// helm only updates the dependencies of the chart being installed
+		subcharts = fetchDependencies(chartDir, metadata, subcharts, prefix == "" && ctx.dependencyUpdate, ctx)
+		for _, dependency := range chartDependencies(metadata, subcharts) {
+			subEnabled := enabled
+			if depEnabled, reason := dependencyEnabled(dependency.dependency, view, ctx.tags); !depEnabled {
+				subEnabled = false
+				if ctx.options.Disabled == "include" {
+					Fdebug("Sub-chart %s is disabled by %s, its values are kept", dependency.key, reason)
+				} else {
+					if ctx.options.Disabled == "report" {
+						Finfo("Sub-chart %s of %s is disabled by %s, its values are left out", dependency.key, chartDir, reason)
+					} else {
+						Fdebug("Sub-chart %s is disabled by %s, its values are left out", dependency.key, reason)
+					}
 					continue
 				}
+			}
 
-				// Récupérer le nom du répertoire
-				dirName := subentries[0].Name()
-				Fdebug("Folder found: %s\n", dirName)
-
-				_, exists := localMap[dirName]
-				if !exists {
-					localMap[dirName] = make(map[string]interface{})
-				}
-
-				searchInChart(tmpDir+string(os.PathSeparator)+id+string(os.PathSeparator)+dirName,
-					dirName,
-					valueFile,
-					globalMap,
-					localMap[dirName].(map[string]interface{}),
-					tagMap,
-					tmpDir)
+			// Recursively search in sub-charts
+			subView, _ := view[dependency.key].(map[string]interface{})
+			sub, scaffolded := subLayers(layers, dependency.key)
+			searchInChart(dependency.chart.dir, subchartPath(prefix, dependency.key),
+				sub,
+				subView,
+				subEnabled,
+				ctx)
+
+			for _, layer := range layers {
+				importValues(dependency.dependency, dependency.key, layer)
 			}
+			pruneSubLayers(layers, dependency.key, scaffolded)
+		}
+	}
+
+	for i := range layers {
+		mergeIntoLayer(chartValues[i], layers[i])
+	}
+	ctx.addSources(sources)
+	if ctx.options.Validate {
+		var schema *chartSchema
+		if enabled {
+			schema = loadChartSchema(chartDir, metadata, path, ctx)
 		}
+		ctx.addOrigins(origins, schema)
 	}
+}
+
+// subchartPath gives the path of a sub-chart in the values of the top chart
+func subchartPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
 
-	filePath := chartDir + string(os.PathSeparator) + valueFile
+// loadValuesFile reads valueFile in chartDir, if it exists. Files encrypted with SOPS
+// are decrypted. Templates are rendered with data, then the environment variables are expanded.
+// The lists are turned into patches by their directives, or by the strategies of config.
+// The documents of the file are merged in order.
+// It returns the values of the file, the nodes of its documents when their layout is preserved,
+// and true if the file was found.
+func loadValuesFile(chartDir *chartFS, valueFile string, data *renderContext, config *chartConfig, ctx *searchContext) (map[string]interface{}, []*yaml.Node, bool) {
+	filePath := chartDir.filePath(valueFile)
 
-	_, err = os.Stat(filePath)
+	_, err := chartDir.stat(valueFile)
 	if err == nil {
 
 		Fdebug("File %s found in %s", valueFile, filePath)
 
-		content, err := os.ReadFile(filePath)
+		content, err := chartDir.readFile(valueFile)
 		if err != nil {
-			Fdebug("Failed to read file %s: %v", filePath, err)
+			ctx.fail("Failed to read file %s: %v", filePath, err)
+			return nil, nil, true
 		}
 
-		var valuesMap map[string]interface{}
-		if err := yaml.Unmarshal(content, &valuesMap); err != nil {
-			Fdebug("Failed to unmarshal YAML: %v", err)
-		}
+		var documents []*valuesDocument
+
+		// Encrypted files are found on their decoded values, whatever their format, and
+		// decrypted in memory. A file which cannot be decrypted is always an error.
+		format := valuesFormat(valueFile, ctx)
+		if decoded, err := decodeValues(content, format, nil); err == nil && sopsEncrypted(decoded) {
+			Fdebug("File %s is encrypted with SOPS", filePath)
+			documents, err = decryptSopsFile(content, format)
+			if err != nil {
+				ctx.refuse("Failed to decrypt %s: %v", filePath, err)
+				return nil, nil, true
+			}
+		} else {
+			if needsRendering(valueFile, ctx) {
+				content, err = renderValuesFile(valueFile, content, data)
+				if err != nil {
+					ctx.fail("Failed to render template %s: %v", filePath, err)
+					return nil, nil, true
+				}
+			}
 
-		// Merge the global values into the globalMap
-		globalValue, exists := valuesMap["global"]
-		if exists {
-			mergeMaps(globalMap, globalValue.(map[string]interface{}))
-			delete(valuesMap, "global")
-		}
+			if ctx.options.Env {
+				var unset []string
+				content, unset = expandEnv(content)
+				if len(unset) > 0 {
+					ctx.fail("Environment variables not set in %s: %s", filePath, strings.Join(unset, ", "))
+				}
+			}
 
-		// Merge the tags into the tagMap
-		tagValue, exists := valuesMap["tags"]
-		if exists {
-			mergeMaps(tagMap, tagValue.(map[string]interface{}))
-			delete(valuesMap, "tags")
+			documents, err = decodeValues(content, format, ctx)
+			if err != nil {
+				ctx.fail("Failed to parse %s file %s: %v", strings.ToUpper(format), filePath, err)
+				return nil, nil, true
+			}
 		}
 
-		// Merge the valuesMap into the localMap
-		mergeMaps(localMap, valuesMap)
+		// The documents of the file are merged in order
+		valuesMap := make(map[string]interface{})
+		var nodes []*yaml.Node
+		for _, document := range documents {
+			if err := parseListPatches(document.values); err != nil {
+				ctx.fail("Bad list patch in %s: %v", filePath, err)
+				return nil, nil, true
+			}
+			config.applyListStrategies(document.values)
+			mergeMaps(valuesMap, document.values)
+			if document.node != nil {
+				nodes = append(nodes, document.node)
+			}
+		}
+		return valuesMap, nodes, true
 
 	} else if os.IsNotExist(err) {
 		Fdebug("File %s does not exist in %s, skipping", valueFile, filePath)
 	} else {
 		// some other error
-		Fwarn("Error checking file %s: %v", filePath, err)
+		ctx.fail("Error checking file %s: %v", filePath, err)
 	}
-
+	return nil, nil, false
 }
 
-// Helper function to remove empty submaps from a map
-func removeEmptyMaps(m map[string]interface{}) {
-	for key, value := range m {
-		if subMap, ok := value.(map[string]interface{}); ok {
-			// Nettoyer récursivement la sous-map
-			removeEmptyMaps(subMap)
+// mergeIntoLayer merges the values of a chart into a layer
+func mergeIntoLayer(valuesMap map[string]interface{}, layer valuesLayer) {
+	// Merge the global values into the globalMap
+	globalValue, exists := valuesMap["global"]
+	if exists {
+		if globals, ok := globalValue.(map[string]interface{}); ok {
+			mergeMaps(layer.globalMap, globals)
+		} else {
+			Fwarn("global must hold a map, %v is ignored", globalValue)
+		}
+		delete(valuesMap, "global")
+	}
 
-			// Si la sous-map est maintenant vide, la supprimer
-			if len(subMap) == 0 {
-				delete(m, key)
-			}
+	// Merge the tags into the tagMap
+	tagValue, exists := valuesMap["tags"]
+	if exists {
+		if tags, ok := tagValue.(map[string]interface{}); ok {
+			mergeMaps(layer.tagMap, tags)
+		} else {
+			Fwarn("tags must hold a map, %v is ignored", tagValue)
 		}
+		delete(valuesMap, "tags")
 	}
+
+	// Merge the valuesMap into the localMap
+	mergeMaps(layer.localMap, valuesMap)
 }
 
 // Core function to print values from a local chart
-// It reads the values file and prints its content to stdout.
-func PrintValues(chartPath string, valueFile string, chart string, tmpDir string) {
+// It reads the values files and prints their aggregated content to stdout.
+// When several files are requested, the chart tree is visited once and the
+// aggregated files are merged in order, the last one winning.
+// resolved is the chart picked for a version constraint, written in a # Chart: comment
+// before the values, except in JSON.
+func PrintValues(chart *chartFS, uri *ChartURI, helmCmd *HelmCommand, cache *chartCache, resolved *ChartSource) error {
+
+	layers := newValuesLayers(len(uri.Files))
+
+	ctx := newSearchContext(uri, helmCmd, cache)
+	searchInChart(chart, "", layers, nil, true, ctx)
+	ctx.checkDocuments()
+	if err := ctx.err(); err != nil {
+		return err
+	}
 
 	localMap := make(map[string]interface{})
 	globalMap := make(map[string]interface{})
 	tagMap := make(map[string]interface{})
 
-	searchInChart(chartPath, "", valueFile, globalMap, localMap, tagMap, tmpDir)
+	for _, layer := range layers {
+		mergeMaps(localMap, layer.localMap)
+		mergeMaps(globalMap, layer.globalMap)
+		mergeMaps(tagMap, layer.tagMap)
+	}
 
-	localMap["global"] = globalMap
-	localMap["tags"] = tagMap
+	// global and tags only hold the values found in the files
+	if len(globalMap) > 0 {
+		localMap["global"] = globalMap
+	}
+	if len(tagMap) > 0 {
+		localMap["tags"] = tagMap
+	}
 
-	removeEmptyMaps(localMap)
+	resolveListPatches(localMap)
 
-	yamlBytes, err := yaml.Marshal(localMap)
-	if err != nil {
-		Fdebug("Failed to marshal YAML: %v", err)
-	} else {
-		fmt.Print(string(yamlBytes))
+	if uri.Options.Validate {
+		if err := validateValues(localMap, ctx); err != nil {
+			return err
+		}
 	}
 
+	out, err := marshalValues(localMap, uri.Options, ctx.sources)
+	if err != nil {
+		return fmt.Errorf("failed to marshal values to %s: %v", uri.Options.Output, err)
+	}
+	if resolved != nil && uri.Options.Output != "json" {
+		// The version picked for a constraint, in a comment scripts can read
+		fmt.Printf("# Chart: %s\n", resolved)
+	}
+	fmt.Print(string(out))
+	return nil
 }
 
 func main() {
@@ -352,16 +661,23 @@ func main() {
 		os.Exit(1)
 	}
 
-	chart, chartVersion, chartRepo := getChart(p.CmdLine)
+	helmCmd := getChart(p.CmdLine)
 
 	if len(os.Args) < 5 {
 		LogError("Wrong command line calling Values plugin.")
 		os.Exit(1)
 	}
 
-	valueFile := strings.Replace(os.Args[4], "chart://", "", 1)
+	// helm calls the downloaders with certFile keyFile caFile URL, empty when not given
+	helmCmd.TLS = tlsFiles{certFile: os.Args[1], keyFile: os.Args[2], caFile: os.Args[3]}
 
-	Fdebug("Fetching %s from chart %s, version \"%s\", repo \"%s\"", valueFile, chart, chartVersion, chartRepo)
+	uri, err := ParseChartURI(os.Args[4])
+	if err != nil {
+		LogError(err.Error())
+		os.Exit(1)
+	}
+
+	Fdebug("Fetching %s from chart %s, version \"%s\", repo \"%s\"", uri, helmCmd.Chart, helmCmd.Version, helmCmd.Repo)
 
 	tmpDir, errret := os.MkdirTemp("", "values-downloader-*")
 	if errret != nil {
@@ -369,43 +685,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	defer os.RemoveAll(tmpDir)
-
 	Fdebug("Created temporary directory: %s", tmpDir)
 
-	// Check if we have chart://values.yaml@repo/remotechart
-	if strings.Contains(valueFile, "@") {
-		parts := strings.Split(valueFile, "@")
-		if len(parts) != 2 {
-			LogError("Invalid value file format. Expected chart://values.yaml@remotechart")
-			os.Exit(1)
-		}
-		chart = parts[1]
-		valueFile = parts[0]
-		chartVersion := ""
-
-		// now split chart into chart name and version
-		if strings.Contains(chart, ":") {
-			chartParts := strings.Split(chart, ":")
-			if len(chartParts) == 2 {
-				chartVersion = chartParts[1]
-				chart = chartParts[0]
-			} else {
-				LogError("Invalid chart format. Expected chart:version")
-				os.Exit(1)
-			}
-		}
+	cache := openChartCache(tmpDir, uri.Options.Offline)
 
-		Fdebug("Using remote chart: %s", chart)
-		getRemote(chart, valueFile, chartVersion, "", tmpDir)
+	// Check if we have chart://values.yaml@repo/remotechart
+	if uri.Source != nil {
+		Fdebug("Using remote chart: %s", uri.Source)
+		err = getRemote(uri.Source, uri, &helmCmd, cache)
 	} else {
 		// Check if it is a local chart or a remote chart. Guess it is a local chart
-		// if we find a Chart.yaml in the path
-		chartYamlPath := chart + string(os.PathSeparator) + "Chart.yaml"
-		if _, statErr := os.Stat(chartYamlPath); os.IsNotExist(statErr) {
-			getRemote(chart, valueFile, chartVersion, chartRepo, tmpDir)
+		// if we find a Chart.yaml in the path, or if the path is an archive
+		chartYamlPath := helmCmd.Chart + string(os.PathSeparator) + "Chart.yaml"
+		if _, statErr := os.Stat(chartYamlPath); os.IsNotExist(statErr) && !isArchiveFile(helmCmd.Chart) {
+			err = getRemote(installedChartSource(helmCmd.Chart, helmCmd.Version, helmCmd.Repo), uri, &helmCmd, cache)
 		} else {
-			getLocal(chart, valueFile, tmpDir)
+			err = getLocal(&helmCmd, uri, cache)
 		}
 	}
+
+	cache.close()
+	os.RemoveAll(tmpDir)
+
+	if err != nil {
+		LogError(err.Error())
+		os.Exit(1)
+	}
 }
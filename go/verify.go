@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"gopkg.in/yaml.v3"
+)
+
+// cosignSignatureAnnotation is the annotation of the layers of a cosign signature giving
+// the signature of the layer
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// chartVerifier checks the signatures of the charts the values are read from: the charts
+// pulled, and the archives of the charts/ folders which are not part of a verified chart.
+//
+// Charts are signed as helm signs them, with a .prov file next to the archive holding its
+// digest, signed with a PGP key of the keyring. Charts of an OCI registry can be signed
+// with cosign instead, when cosign public keys are given.
+type chartVerifier struct {
+	keyringPath string
+	keyring     openpgp.EntityList
+	// cosignKeyPaths are the PEM files of the cosign public keys
+	cosignKeyPaths []string
+	cosignKeys     []crypto.PublicKey
+	// tls are the files given by helm to read the cosign signatures in the registry
+	tls tlsFiles
+}
+
+// newChartVerifier returns the verifier of the charts with verify=true or helm --verify,
+// nil if the charts are not verified. The keyring is the one given to helm with --keyring,
+// else ROCKVALUES_KEYRING, else the default keyring of helm. The cosign public keys are
+// given in ROCKVALUES_COSIGN_KEYS, as a list of files.
+func newChartVerifier(options URIOptions, helmCmd *HelmCommand) *chartVerifier {
+	if !options.Verify && (helmCmd == nil || !helmCmd.Verify) {
+		return nil
+	}
+
+	verifier := &chartVerifier{keyringPath: os.Getenv("ROCKVALUES_KEYRING")}
+	if helmCmd != nil {
+		if helmCmd.Keyring != "" {
+			verifier.keyringPath = helmCmd.Keyring
+		}
+		verifier.tls = helmCmd.TLS
+	}
+	if verifier.keyringPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			verifier.keyringPath = filepath.Join(home, ".gnupg", "pubring.gpg")
+		}
+	}
+	for _, path := range filepath.SplitList(os.Getenv("ROCKVALUES_COSIGN_KEYS")) {
+		if path != "" {
+			verifier.cosignKeyPaths = append(verifier.cosignKeyPaths, path)
+		}
+	}
+	return verifier
+}
+
+// usesCosign tells if a chart is verified with cosign rather than with its .prov file
+func (v *chartVerifier) usesCosign(source *ChartSource) bool {
+	return source.IsOCI() && len(v.cosignKeyPaths) > 0
+}
+
+// verifyProvenance checks the .prov file of a chart archive: its signature with the keyring,
+// and the digest it holds, against content, the archive as it is read
+func (v *chartVerifier) verifyProvenance(archive string, content []byte) error {
+	keyring, err := v.loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	provPath := archive + ".prov"
+	prov, err := os.ReadFile(provPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no provenance file %s", filepath.Base(provPath))
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := clearsign.Decode(prov)
+	if block == nil {
+		return fmt.Errorf("%s is not a signed provenance file", filepath.Base(provPath))
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return fmt.Errorf("signature of %s not valid with keyring %s: %v", filepath.Base(provPath), v.keyringPath, err)
+	}
+
+	// The signed message is the Chart.yaml of the chart, then the digests of the files
+	parts := bytes.SplitN(block.Plaintext, []byte("\n...\n"), 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%s holds no digest", filepath.Base(provPath))
+	}
+	var sums struct {
+		Files map[string]string `yaml:"files"`
+	}
+	if err := yaml.Unmarshal(parts[1], &sums); err != nil {
+		return fmt.Errorf("bad digests in %s: %v", filepath.Base(provPath), err)
+	}
+	expected, ok := sums.Files[filepath.Base(archive)]
+	if !ok {
+		return fmt.Errorf("%s holds no digest of %s", filepath.Base(provPath), filepath.Base(archive))
+	}
+	if digest := contentDigest(content); expected != digest {
+		return fmt.Errorf("%s has digest %s, signed digest is %s", filepath.Base(archive), digest, expected)
+	}
+
+	for name := range signer.Identities {
+		Fdebug("Chart %s signed by %s", filepath.Base(archive), name)
+	}
+	return nil
+}
+
+// loadKeyring reads the keyring once, binary or armored
+func (v *chartVerifier) loadKeyring() (openpgp.EntityList, error) {
+	if v.keyring != nil {
+		return v.keyring, nil
+	}
+	content, err := os.ReadFile(v.keyringPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keyring: %v", err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN")) {
+		v.keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	} else {
+		v.keyring, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keyring %s: %v", v.keyringPath, err)
+	}
+	return v.keyring, nil
+}
+
+// verifyCosign checks that the manifest of an OCI chart, given by its digest, has a cosign
+// signature made with one of the cosign keys, and that its chart layer is content, the
+// archive as it is read. The signature is read in the registry, at the tag
+// sha256-<digest>.sig.
+func (v *chartVerifier) verifyCosign(source *ChartSource, digest string, content []byte) error {
+	keys, err := v.loadCosignKeys()
+	if err != nil {
+		return err
+	}
+	if digest == "" {
+		return fmt.Errorf("digest of the chart unknown")
+	}
+
+	registry, err := newRegistryClient(source.Chart, v.tls)
+	if err != nil {
+		return err
+	}
+	// The signature is bound to the archive by the manifest it signs
+	signed, err := registry.manifest(digest)
+	if err != nil {
+		return fmt.Errorf("cannot read the manifest of the chart: %v", err)
+	}
+	layer, err := signed.chartLayer()
+	if err != nil {
+		return err
+	}
+	if archiveDigest := contentDigest(content); layer != archiveDigest {
+		return fmt.Errorf("archive has digest %s, signed manifest holds %s", archiveDigest, layer)
+	}
+
+	manifest, err := registry.manifest(strings.Replace(digest, ":", "-", 1) + ".sig")
+	if err != nil {
+		return fmt.Errorf("no cosign signature: %v", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		payload, err := registry.blob(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		// The payload is a simple signing document naming the signed manifest
+		var simpleSigning struct {
+			Critical struct {
+				Image struct {
+					Digest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		if err := json.Unmarshal(payload, &simpleSigning); err != nil || simpleSigning.Critical.Image.Digest != digest {
+			Fdebug("Cosign signature %s is not a signature of %s", layer.Digest, digest)
+			continue
+		}
+		for i, key := range keys {
+			if verifySignature(key, payload, signature) {
+				Fdebug("Chart %s signed with cosign key %s", source, v.cosignKeyPaths[i])
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no cosign signature of %s made with the keys %s", digest, strings.Join(v.cosignKeyPaths, ", "))
+}
+
+// loadCosignKeys reads the PEM public keys of cosign once
+func (v *chartVerifier) loadCosignKeys() ([]crypto.PublicKey, error) {
+	if v.cosignKeys != nil {
+		return v.cosignKeys, nil
+	}
+	var keys []crypto.PublicKey
+	for _, path := range v.cosignKeyPaths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read cosign key: %v", err)
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("cosign key %s is not a PEM file", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("bad cosign key %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	v.cosignKeys = keys
+	return keys, nil
+}
+
+// verifySignature checks a signature of a payload as cosign makes them
+func verifySignature(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	default:
+		return false
+	}
+}
+
+// fileDigest returns the sha256:... digest of a file
+func fileDigest(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return contentDigest(content), nil
+}
+
+// contentDigest returns the sha256:... digest of a content
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
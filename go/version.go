@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// repoIndex is the part of a helm repository index.yaml used to resolve versions
+type repoIndex struct {
+	Entries map[string][]repoIndexEntry `yaml:"entries"`
+}
+
+type repoIndexEntry struct {
+	Version string   `yaml:"version"`
+	Digest  string   `yaml:"digest"`
+	URLs    []string `yaml:"urls"`
+}
+
+// isExactVersion tells if version is a version and not a constraint (~1.2, ^2.0, >=1.0 <2.0...)
+func isExactVersion(version string) bool {
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(version, "v"))
+	return err == nil
+}
+
+// resolveChartVersion replaces the version of a chart of a helm repository by the exact
+// version helm would pick: the highest version of the repository index matching the
+// constraint. Without version, this is the latest stable version, or the latest
+// version including pre-releases if devel is set, as helm --devel does.
+// It returns true when the version has been resolved.
+func resolveChartVersion(source *ChartSource, devel bool) (bool, error) {
+	if source.Version != "" && isExactVersion(source.Version) {
+		return false, nil
+	}
+
+	// Only the indexes of the repositories added with helm repo add are in the cache
+	if source.IsOCI() || source.IsArchive() || source.Repo != "" || !strings.Contains(source.Chart, "/") {
+		Fdebug("Version of %s resolved by helm", source)
+		return false, nil
+	}
+
+	constraintStr := source.Version
+	if constraintStr == "" {
+		constraintStr = "*"
+		if devel {
+			constraintStr = ">0.0.0-0"
+		}
+	}
+	constraint, err := semver.NewConstraint(constraintStr)
+	if err != nil {
+		return false, fmt.Errorf("invalid version constraint %q for chart %s: %v", source.Version, source.Chart, err)
+	}
+
+	repoName := strings.Split(source.Chart, "/")[0]
+	index, err := loadRepoIndex(repoName)
+	if err != nil {
+		return false, err
+	}
+	if index == nil {
+		Fdebug("No index in the helm cache for repository %s, version of %s resolved by helm", repoName, source)
+		return false, nil
+	}
+
+	entries, exists := index.Entries[source.Name()]
+	if !exists {
+		return false, fmt.Errorf("chart %s not found in the index of repository %s", source.Name(), repoName)
+	}
+
+	version, err := highestMatchingVersion(entries, constraint)
+	if err != nil {
+		return false, fmt.Errorf("no version of chart %s matches %q: %v", source.Chart, constraintStr, err)
+	}
+
+	Fdebug("Version %q of chart %s resolved to %s", source.Version, source.Chart, version)
+	source.Version = version
+	return true, nil
+}
+
+// highestMatchingVersion returns the highest version of the entries matching the constraint
+func highestMatchingVersion(entries []repoIndexEntry, constraint *semver.Constraints) (string, error) {
+	var versions []*semver.Version
+	original := map[*semver.Version]string{}
+	for _, entry := range entries {
+		version, err := semver.NewVersion(entry.Version)
+		if err != nil {
+			Fdebug("Skipping invalid version %s: %v", entry.Version, err)
+			continue
+		}
+		versions = append(versions, version)
+		original[version] = entry.Version
+	}
+	sort.Sort(sort.Reverse(semver.Collection(versions)))
+
+	for _, version := range versions {
+		if constraint.Check(version) {
+			return original[version], nil
+		}
+	}
+	return "", fmt.Errorf("%d versions in the index", len(versions))
+}
+
+// loadRepoIndex reads the index of a repository in the helm cache.
+// It returns nil if the index is not in the cache.
+func loadRepoIndex(repoName string) (*repoIndex, error) {
+	cacheDir := os.Getenv("HELM_REPOSITORY_CACHE")
+	if cacheDir == "" {
+		return nil, nil
+	}
+
+	indexPath := filepath.Join(cacheDir, repoName+"-index.yaml")
+	content, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of repository %s: %v", repoName, err)
+	}
+
+	var index repoIndex
+	if err := yaml.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %v", indexPath, err)
+	}
+	return &index, nil
+}
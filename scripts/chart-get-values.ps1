@@ -22,6 +22,21 @@ function Show-Usage {
 Show-Debug "Helm get values tester"
 Show-Debug "$args"
 
+# The empty arguments are dropped by Windows PowerShell: they are passed quoted, the legacy way
+$PSNativeCommandArgumentPassing = 'Legacy'
+
+# The certificate, key and CA are given to the downloader, as helm install does
+$tlsFiles = @{ "--cert-file" = '""'; "--key-file" = '""'; "--ca-file" = '""' }
+for ($i = 0; $i -lt $args.Count; $i++) {
+    foreach ($flag in @("--cert-file", "--key-file", "--ca-file")) {
+        if ($args[$i] -eq $flag -and $i + 1 -lt $args.Count) {
+            $tlsFiles[$flag] = $args[$i + 1]
+        } elseif ($args[$i] -like "$flag=*") {
+            $tlsFiles[$flag] = $args[$i].Substring($flag.Length + 1)
+        }
+    }
+}
+
 $argList = $args
 while ($argList.Count -gt 1) {
     if ($argList[0] -eq "-f") {
@@ -29,7 +44,7 @@ while ($argList.Count -gt 1) {
         $file = $argList[0]
         Write-Host "# Source: $file"
         if ($file -match "^chart://") {
-            & "$env:HELM_PLUGIN_DIR/rockvalues.exe" certFile keyFile caFile $file
+            & "$env:HELM_PLUGIN_DIR/rockvalues.exe" $tlsFiles["--cert-file"] $tlsFiles["--key-file"] $tlsFiles["--ca-file"] $file
             if ($LASTEXITCODE -ne 0) { exit 1 }
         } else {
             if (Test-Path $file) {
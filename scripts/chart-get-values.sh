@@ -32,13 +32,29 @@ usage() {
 debug "Helm get values tester"
 debug "$*"
 
+# The certificate, key and CA are given to the downloader, as helm install does
+CERT_FILE=""
+KEY_FILE=""
+CA_FILE=""
+ARGS=("$@")
+for ((i = 0; i < ${#ARGS[@]}; i++)); do
+    case "${ARGS[$i]}" in
+        --cert-file) CERT_FILE=${ARGS[$((i + 1))]} ;;
+        --cert-file=*) CERT_FILE=${ARGS[$i]#*=} ;;
+        --key-file) KEY_FILE=${ARGS[$((i + 1))]} ;;
+        --key-file=*) KEY_FILE=${ARGS[$i]#*=} ;;
+        --ca-file) CA_FILE=${ARGS[$((i + 1))]} ;;
+        --ca-file=*) CA_FILE=${ARGS[$i]#*=} ;;
+    esac
+done
+
 while [ -n "$1" ]; do
     if [ "$1" = "-f" ]; then
         shift
         echo "# Source: $1"
         echo "$1" | grep "^chart://" > /dev/null
         if [ $? = 0 ]; then
-            $HELM_PLUGIN_DIR/rockvalues certFile keyFile caFile "$1" || exit 1
+            $HELM_PLUGIN_DIR/rockvalues "$CERT_FILE" "$KEY_FILE" "$CA_FILE" "$1" || exit 1
         else
             cat $1 || echo "# File does not exist"
         fi
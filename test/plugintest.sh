@@ -21,13 +21,15 @@ oneTimeSetUp() {
     TOP=$(readlink -f $(dirname $0))
     YQ=$TOP/../yq
 
-    rm -rf $TOP/appgz
-    cp -r $TOP/app $TOP/appgz
-    pushd $TOP/appgz/charts || exit 1
+    for APP in app alias legacy conditions imports lists; do
+        rm -rf $TOP/${APP}gz
+        cp -r $TOP/$APP $TOP/${APP}gz
+        pushd $TOP/${APP}gz/charts || exit 1
 
-    compress .
+        compress .
 
-    popd
+        popd
+    done
 
     helm repo add ingress-nginx-valuetest https://kubernetes.github.io/ingress-nginx
     helm repo update
@@ -36,7 +38,7 @@ oneTimeSetUp() {
 
 oneTimeTearDown() {
     test -f /tmp/test.yaml && rm /tmp/test.yaml || true
-    rm -rf $TOP/appgz || true
+    rm -rf $TOP/appgz $TOP/aliasgz $TOP/legacygz $TOP/conditionsgz $TOP/importsgz $TOP/listsgz || true
 
     if helm repo ls | grep -q ingress-nginx-valuetest; then
         helm repo remove ingress-nginx-valuetest || true
@@ -238,6 +240,21 @@ testRemoteWithVersionOfValues() {
 }
 
 
+# Get data from a remote chart with a version constraint
+# The version picked is logged, and written in a comment before the values
+testRemoteWithVersionConstraint() {
+    LOGS=$(helm values -f "chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:>=4.12.0 <4.12.1" test app 2>&1 > /tmp/test.yaml)
+    check version 4.12.0
+    echo "$LOGS" | grep -q "Using chart ingress-nginx-valuetest/ingress-nginx:4.12.0$"
+    assertEquals "The resolved version must be logged" 0 $?
+    grep -q "^# Chart: ingress-nginx-valuetest/ingress-nginx:4.12.0$" /tmp/test.yaml
+    assertEquals "The resolved version must be written in the output" 0 $?
+
+    helm values -f "chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:>=4.12.0 <4.12.1?output=json" test app | grep -q "^# Chart:"
+    assertNotEquals "JSON output holds no comment" 0 $?
+}
+
+
 # Get values in the chart with a specific version
 
 testRemoteWithVersion() {
@@ -262,6 +279,143 @@ testRemoteWithVersion() {
 
 
 
+#===========================================
+
+# Get data from a chart in an OCI registry
+# Needs a registry, for instance a local stand-in started with
+#   docker run -d -p 5000:5000 registry:2
+# and OCI_REGISTRY=localhost:5000
+testRemoteOci() {
+    if [ -z "$OCI_REGISTRY" ]; then
+        startSkipping
+    fi
+
+    helm package $TOP/app --version 1.2.0 -d /tmp
+    helm push /tmp/value-plugin-test-1.2.0.tgz oci://$OCI_REGISTRY/test
+    DIGEST=$(helm pull oci://$OCI_REGISTRY/test/value-plugin-test --version 1.2.0 -d /tmp | sed -n 's/^Digest: //p')
+
+    helm values -f chart://extra2.yaml@oci://$OCI_REGISTRY/test/value-plugin-test:1.2.0 test app > /tmp/test.yaml
+    check extra value
+    check subchart1.extra2 value2
+
+    helm values -f chart://extra2.yaml@oci://$OCI_REGISTRY/test/value-plugin-test@$DIGEST test app > /tmp/test.yaml
+    check extra value
+
+    helm values -f chart://extra2.yaml@oci://$OCI_REGISTRY/test/value-plugin-test@sha256:0000000000000000000000000000000000000000000000000000000000000000 test app > /dev/null
+    assertNotEquals "A wrong digest is an error" 0 $?
+
+    rm -f /tmp/value-plugin-test-1.2.0.tgz
+    endSkipping
+}
+
+#===========================================
+
+# Get data from a chart given by URL, without helm repo add
+testRemoteUrl() {
+    helm values -f chart://Chart.yaml@https://kubernetes.github.io/ingress-nginx//ingress-nginx:4.12.0 test app > /tmp/test.yaml
+    check name ingress-nginx
+    check version 4.12.0
+
+    helm values -f chart://Chart.yaml@https://github.com/kubernetes/ingress-nginx/releases/download/helm-chart-4.12.0/ingress-nginx-4.12.0.tgz test app > /tmp/test.yaml
+    check name ingress-nginx
+    check version 4.12.0
+}
+
+# Get data from a chart repository served locally, downloaded without helm pull
+testRemoteNative() {
+    if ! command -v python3 > /dev/null; then
+        startSkipping
+    fi
+
+    REPO=$(mktemp -d)
+    helm package $TOP/app --version 1.3.0 -d $REPO
+    helm repo index $REPO --url http://localhost:8879
+    (cd $REPO && exec python3 -m http.server 8879 > /dev/null 2>&1) &
+    SERVER=$!
+    sleep 1
+
+    HELM_DEBUG=true helm values -f chart://extra2.yaml@http://localhost:8879//value-plugin-test:1.3.0 test app > /tmp/test.yaml 2> /tmp/test.log
+    check extra value
+    grep -q "Downloading chart" /tmp/test.log
+    assertEquals "Charts of a repository URL are downloaded by the plugin" 0 $?
+    grep -q "Pulling chart" /tmp/test.log
+    assertNotEquals "Charts of a repository URL are not pulled with helm" 0 $?
+
+    # Repository added with helm repo add, in a separate helm configuration
+    export HELM_REPOSITORY_CONFIG=$REPO/repositories.yaml HELM_REPOSITORY_CACHE=$REPO/cache
+    helm repo add rockvalues-native http://localhost:8879
+    HELM_DEBUG=true helm values -f "chart://extra2.yaml@rockvalues-native/value-plugin-test:~1.3" test app > /tmp/test.yaml 2> /tmp/test.log
+    check extra value
+    grep -q "Downloading chart" /tmp/test.log
+    assertEquals "Charts of the repositories of helm are downloaded by the plugin" 0 $?
+
+    ROCKVALUES_HELM_PULL=true helm values -f chart://extra2.yaml@rockvalues-native/value-plugin-test:1.3.0 test app > /tmp/test.yaml
+    check extra value
+    unset HELM_REPOSITORY_CONFIG HELM_REPOSITORY_CACHE
+
+    kill $SERVER
+    rm -rf $REPO /tmp/test.log
+    endSkipping
+}
+
+# Charts of a repository served over https with a test CA, which needs a client certificate.
+# helm values gives --cert-file, --key-file and --ca-file to the downloader, as helm install does
+testRemoteTls() {
+    if ! command -v python3 > /dev/null || ! command -v openssl > /dev/null; then
+        startSkipping
+    fi
+
+    TLS=$(mktemp -d)
+    openssl req -x509 -newkey rsa:2048 -nodes -keyout $TLS/ca.key -out $TLS/ca.crt -days 1 -subj /CN=rockvalues-test-ca
+    openssl req -newkey rsa:2048 -nodes -keyout $TLS/server.key -out $TLS/server.csr -subj /CN=localhost
+    printf 'subjectAltName=DNS:localhost\n' > $TLS/server.ext
+    openssl x509 -req -in $TLS/server.csr -CA $TLS/ca.crt -CAkey $TLS/ca.key -CAcreateserial -out $TLS/server.crt -days 1 -extfile $TLS/server.ext
+    openssl req -newkey rsa:2048 -nodes -keyout $TLS/client.key -out $TLS/client.csr -subj /CN=rockvalues-test-client
+    openssl x509 -req -in $TLS/client.csr -CA $TLS/ca.crt -CAkey $TLS/ca.key -CAcreateserial -out $TLS/client.crt -days 1
+
+    REPO=$(mktemp -d)
+    helm package $TOP/app --version 1.4.0 -d $REPO
+    helm repo index $REPO --url https://localhost:8443
+    (cd $REPO && exec python3 -c '
+import http.server, ssl, sys
+context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+context.load_cert_chain(sys.argv[1] + "/server.crt", sys.argv[1] + "/server.key")
+context.load_verify_locations(sys.argv[1] + "/ca.crt")
+context.verify_mode = ssl.CERT_REQUIRED
+server = http.server.HTTPServer(("localhost", 8443), http.server.SimpleHTTPRequestHandler)
+server.socket = context.wrap_socket(server.socket, server_side=True)
+server.serve_forever()
+' $TLS > /dev/null 2>&1) &
+    SERVER=$!
+    sleep 1
+
+    URI=chart://extra2.yaml@https://localhost:8443//value-plugin-test:1.4.0
+    helm values -f $URI test app > /dev/null
+    assertNotEquals "The CA of the server is needed" 0 $?
+
+    helm values --ca-file $TLS/ca.crt -f $URI test app > /dev/null
+    assertNotEquals "The client certificate is needed" 0 $?
+
+    HELM_DEBUG=true helm values --cert-file $TLS/client.crt --key-file $TLS/client.key --ca-file $TLS/ca.crt -f $URI test app > /tmp/test.yaml 2> /tmp/test.log
+    assertEquals "Charts are downloaded with the TLS files given by helm" 0 $?
+    check extra value
+    grep -q "Downloading chart" /tmp/test.log
+    assertEquals "Charts of a repository URL are downloaded by the plugin" 0 $?
+
+    # helm pull is given the TLS files too. Plugins run the helm of HELM_BIN, which helm
+    # sets to the name it is called with: a helm stub first in the PATH sees the pull
+    STUB=$(mktemp -d)
+    printf '#!/usr/bin/env bash\nif [ "$1" = pull ]; then echo "$@" > %s/pull.args; exit 1; fi\nexec -a helm %s "$@"\n' $STUB "$(command -v helm)" > $STUB/helm
+    chmod +x $STUB/helm
+    PATH=$STUB:$PATH HELM_BIN=$STUB/helm ROCKVALUES_HELM_PULL=true helm values --cert-file $TLS/client.crt --key-file $TLS/client.key --ca-file $TLS/ca.crt -f $URI test app > /dev/null
+    grep -q -- "--cert-file $TLS/client.crt --key-file $TLS/client.key --ca-file $TLS/ca.crt" $STUB/pull.args
+    assertEquals "helm pull is given the TLS files" 0 $?
+
+    kill $SERVER
+    rm -rf $TLS $REPO $STUB /tmp/test.log
+    endSkipping
+}
+
 #===========================================
 
 testTemplateGlobalOverride() {
@@ -483,6 +637,670 @@ testNestedOvergz() {
 }
 
 
+#===========================================
+# Several files in one URI, merged in order
+# The last file wins, at every level of the chart tree
+
+layeredFiles() {
+    helm values -f chart://layer1.yaml,layer2.yaml test $1 > /tmp/test.yaml
+
+    check layer env
+    check keep base
+    check subchart1.layer env-sub
+    check subchart1.keep base-sub
+
+    # layer2.yaml of subchart1 comes after layer1.yaml of the main chart
+    check global.layer env-sub
+}
+
+testLayeredFiles() {
+    layeredFiles app
+}
+
+testLayeredFilesgz() {
+    layeredFiles appgz
+}
+
+
+#===========================================
+# Patterns matching several files in each chart
+# The matching files are merged in lexical order
+
+globFiles() {
+    helm values -f 'chart://values.d/*.yaml' test $1 > /tmp/test.yaml
+
+    check fragment a
+    check from b
+    check subchart2.fragment sub2
+
+    helm values -f 'chart://**/dev.yaml' test $1 > /tmp/test.yaml
+
+    check subchart2.dev false
+    check subchart3.subchart3_1.dev true
+}
+
+testGlobFiles() {
+    globFiles app
+}
+
+testGlobFilesgz() {
+    globFiles appgz
+}
+
+
+#===========================================
+# Options given in the query of the URI
+
+uriOptions() {
+    helm values -f 'chart://over.yaml?subcharts=false' test $1 > /tmp/test.yaml
+
+    check global.gv1 top
+    check global.gv2 ""
+    check subchart3.subchart3_1.subchart3_1_1.v2 ""
+
+    helm values -f 'chart://over.yaml?output=json' test $1 > /tmp/test.yaml
+
+    check global.gv2 depth1
+    check subchart3.subchart3_1.subchart3_1_1.v4 depth3
+}
+
+testUriOptions() {
+    uriOptions app
+}
+
+testUriOptionsgz() {
+    uriOptions appgz
+}
+
+testStrict() {
+    helm values -f 'chart://over.yaml,missing.yaml' test app > /dev/null
+    assertEquals "A missing file is not an error by default" 0 $?
+
+    helm values -f 'chart://over.yaml,missing.yaml?strict=true' test app > /dev/null
+    assertNotEquals "A missing file is an error in strict mode" 0 $?
+}
+
+testEnv() {
+    ROCKVALUES_TEST_ENDPOINT=https://api.dev helm values -f 'chart://values-env.yaml?env=true' test app > /tmp/test.yaml
+
+    check endpoint https://api.dev
+    check port 8080
+    check empty ""
+    check script 'echo ${HOME} $PATH'
+
+    # Unset variables are kept, with a warning
+    check 'command[2]' 'echo ${POD_NAME}'
+
+    helm values -f 'chart://values-env.yaml?env=true&strict=true' test app > /dev/null
+    assertNotEquals "An unset variable is an error in strict mode" 0 $?
+}
+
+testEnvNotExpandedByDefault() {
+    ROCKVALUES_TEST_ENDPOINT=https://api.dev helm values -f 'chart://values-env.yaml' test app > /tmp/test.yaml
+
+    check endpoint '${ROCKVALUES_TEST_ENDPOINT}'
+    check port '${ROCKVALUES_TEST_PORT:-8080}'
+    check script 'echo $${HOME} $PATH'
+    check 'command[2]' 'echo ${POD_NAME}'
+
+    helm values -f 'chart://values-env.yaml?strict=true' test app > /dev/null
+    assertEquals "Placeholders are not checked without env=true" 0 $?
+}
+
+testRender() {
+    helm values -f 'chart://release.tpl.yaml' -n team test app > /tmp/test.yaml
+
+    check release test
+    check namespace team
+    check chart value-plugin-test
+    check path top
+
+    # Same file in a sub-chart
+    check subchart3.subchart3_1.chart subchart3_1
+    check subchart3.subchart3_1.path subchart3.subchart3_1
+}
+
+testSops() {
+    SOPS_AGE_KEY_FILE=$TOP/age-key.txt helm values -f 'chart://secrets.enc.yaml' test app > /tmp/test.yaml
+
+    check database.password s3cr3t
+    check database.port 5432
+    check database.ssl true
+    check database.hosts[1] db2
+    check database.comment_unencrypted visible
+    check sops ""
+
+    SOPS_AGE_KEY_FILE=/nonexistent helm values -f 'chart://secrets.enc.yaml' test app > /dev/null
+    assertNotEquals "A file which cannot be decrypted is an error, even without strict" 0 $?
+
+    helm values -f 'chart://secrets.enc.toml' test app > /dev/null
+    assertNotEquals "A TOML file with SOPS metadata is an error" 0 $?
+}
+
+# Files encrypted by sops itself, in YAML and JSON
+testSopsEncrypted() {
+    if ! command -v sops > /dev/null; then
+        startSkipping
+    fi
+
+    CHART=$(mktemp -d)
+    cp -r $TOP/app/. $CHART
+    RECIPIENT=$(sed -n 's/^# public key: //p' $TOP/age-key.txt)
+    printf 'database:\n  password: s3cr3t\n  port: 5432\n  hosts: [db1, db2]\n' > $CHART/plain.yaml
+    printf '{"database": {"password": "s3cr3t", "port": 5432, "ssl": true}}\n' > $CHART/plain.json
+    sops encrypt --age $RECIPIENT $CHART/plain.yaml > $CHART/generated.enc.yaml
+    sops encrypt --age $RECIPIENT $CHART/plain.json > $CHART/generated.enc.json
+
+    SOPS_AGE_KEY_FILE=$TOP/age-key.txt helm values -f 'chart://generated.enc.yaml' test $CHART > /tmp/test.yaml
+    check database.password s3cr3t
+    check database.port 5432
+    check database.hosts[1] db2
+    check sops ""
+
+    SOPS_AGE_KEY_FILE=$TOP/age-key.txt helm values -f 'chart://generated.enc.json' test $CHART > /tmp/test.yaml
+    check database.password s3cr3t
+    check database.port 5432
+    check database.ssl true
+    check sops ""
+
+    SOPS_AGE_KEY_FILE=/nonexistent helm values -f 'chart://generated.enc.json' test $CHART > /dev/null
+    assertNotEquals "A JSON file which cannot be decrypted is an error" 0 $?
+
+    rm -rf "${CHART:?}"
+    endSkipping
+}
+
+testInvalidUri() {
+    helm values -f 'chart://over.yaml?unknown=true' test app > /dev/null
+    assertNotEquals "Unknown options are rejected" 0 $?
+
+    helm values -f 'chart://over.yaml@chart:1.0:2' test app > /dev/null
+    assertNotEquals "Invalid charts are rejected" 0 $?
+
+    ERRORS=$(helm values -f 'chart://%' test app 2>&1 > /dev/null)
+    echo "$ERRORS" | grep -qF 'invalid chart URI "chart://%":'
+    assertEquals "Errors are printed as they are" 0 $?
+}
+
+# canonicalUri prints the canonical form of a URI, logged by the plugin
+canonicalUri() {
+    HELM_DEBUG=true helm values -f "$1" test app 2>&1 > /dev/null | sed -n 's/.*Fetching \(chart:[^ ]*\) from chart.*/\1/p' | head -1
+}
+
+# assertRoundTrip checks the canonical form of a URI, and that it gives itself back
+assertRoundTrip() {
+    CANONICAL=$(canonicalUri "$1")
+    assertEquals "Canonical form of $1" "$2" "$CANONICAL"
+    assertEquals "Canonical form of $2 parsed again" "$2" "$(canonicalUri "$CANONICAL")"
+}
+
+testUriRoundTrip() {
+    # Encoded file names, options sorted, default options left out
+    assertRoundTrip 'chart://a%2Cb.yaml,c%40d%3F.yaml,100%25.yaml?subcharts=false&render=false&strict=true' \
+        'chart://a%2Cb.yaml,c%40d%3F.yaml,100%25.yaml?strict=true&subcharts=false'
+
+    # OCI chart with a port, a version and a digest
+    DIGEST=sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+    assertRoundTrip "chart://values.yaml@oci://localhost:5000/charts/app:1.0.0@$DIGEST?offline=true" \
+        "chart://values.yaml@oci://localhost:5000/charts/app:1.0.0@$DIGEST?offline=true"
+
+    # Archive URL with a query: the options start after the last "?"
+    assertRoundTrip 'chart://values.yaml@https://charts.example.com/app-1.0.0.tgz?token=x?offline=true' \
+        'chart://values.yaml@https://charts.example.com/app-1.0.0.tgz?token=x?offline=true'
+    assertRoundTrip 'chart://values.yaml@https://charts.example.com/app-1.0.0.tgz?token=x?' \
+        'chart://values.yaml@https://charts.example.com/app-1.0.0.tgz?token=x?'
+}
+
+
+#===========================================
+# Values of sub-charts are keyed as helm does: by the alias of the
+# dependency in the parent chart, or else by the name of the chart
+# The folders of the sub-charts do not have the name of the charts
+
+aliases() {
+    helm values -f chart://values-dev.yaml test $1 > /tmp/test.yaml
+
+    check top value
+
+    # Same chart pulled twice under 2 aliases
+    check first.common value
+    check first.fromparent ok
+    check second.common value
+
+    # Dependency without alias
+    check other.other value
+
+    check common-dir ""
+    check other-dir ""
+}
+
+testAliases() {
+    aliases alias
+}
+
+testAliasesgz() {
+    aliases aliasgz
+}
+
+legacyAliases() {
+    helm values -f chart://values-dev.yaml test $1 > /tmp/test.yaml
+
+    check legacy.common value
+    check common ""
+}
+
+testLegacyAliases() {
+    legacyAliases legacy
+}
+
+testLegacyAliasesgz() {
+    legacyAliases legacygz
+}
+
+
+#===========================================
+# Dependencies disabled by their condition or tags are left out
+# The conditions are evaluated with the values of the requested file
+# and the default values of the chart
+
+conditions() {
+    helm values -f chart://values-dev.yaml test $1 > /tmp/test.yaml
+
+    # Enabled in values.yaml
+    check on-by-default.value ok
+
+    # Disabled in values.yaml
+    check off-by-default.value ""
+
+    # Enabled in values.yaml, disabled in values-dev.yaml
+    check switched-off.enabled false
+    check switched-off.value ""
+
+    # Disabled by a tag
+    check tagged.value ""
+
+    # Disabled by a tag, enabled by its condition
+    check tagged-with-condition.value ok
+
+    helm values -f 'chart://values-dev.yaml?disabled=include' test $1 > /tmp/test.yaml
+
+    check off-by-default.value ok
+    check tagged.value ok
+
+    # The schema of a disabled sub-chart rejects its values.yaml, but helm does not use it
+    helm values -f 'chart://values-dev.yaml?validate=true' test $1 > /dev/null
+    assertEquals "Disabled sub-charts are not validated" 0 $?
+    helm values -f 'chart://values-dev.yaml?validate=true&disabled=include' test $1 > /dev/null
+    assertEquals "Disabled sub-charts whose values are kept are not validated" 0 $?
+    helm values -f 'chart://values-on.yaml?validate=true' test $1 > /dev/null
+    assertNotEquals "Enabled, the sub-chart is validated" 0 $?
+}
+
+testConditions() {
+    conditions conditions
+}
+
+testConditionsgz() {
+    conditions conditionsgz
+}
+
+
+#===========================================
+# import-values of the dependencies move values of sub-charts
+# into the values of their parent
+
+importValues() {
+    helm values -f chart://values-dev.yaml test $1 > /tmp/test.yaml
+
+    # exports form
+    check exported fromchild
+
+    # child/parent form, the values of the parent take precedence
+    check database.host parenthost
+    check database.port 5432
+
+    # The values stay in the sub-chart
+    check child.settings.db.host childhost
+}
+
+testImportValues() {
+    importValues imports
+}
+
+testImportValuesgz() {
+    importValues importsgz
+}
+
+listStrategies() {
+    helm values -f 'chart://base.yaml,overlay.yaml' test $1 > /tmp/test.yaml
+
+    # Merged by name
+    check env[0].value 1
+    check env[1].value 20
+    check env[2].name C
+
+    check args[1] --b
+
+    # Strategy of .rockvalues.yaml
+    check ports[0].name web
+    check ports[1].containerPort 443
+
+    # Replaced by default
+    check hosts[0] two
+    check hosts[1] ""
+
+    # Patch of a list of a sub-chart
+    check worker.extraArgs[0] --first
+    check worker.extraArgs[1] --worker
+}
+
+testListStrategies() {
+    listStrategies lists
+}
+
+testListStrategiesgz() {
+    listStrategies listsgz
+}
+
+authoredValues() {
+    helm values -f 'chart://authored.yaml' test $1 > /tmp/test.yaml
+
+    grep -q '^resources: {}$' /tmp/test.yaml
+    assertEquals "An empty map written in a file is kept" 0 $?
+    grep -q '^nodeSelector: null$' /tmp/test.yaml
+    assertEquals "A null written in a file is kept" 0 $?
+    grep -q '^ *podAnnotations: {}$' /tmp/test.yaml
+    assertEquals "An empty map written for a sub-chart is kept" 0 $?
+    grep -q '^ *affinity: {}$' /tmp/test.yaml
+    assertEquals "An empty map written in a sub-chart is kept" 0 $?
+
+    # Sub-charts without the file leave no empty map
+    check subchart3 ""
+    check global ""
+
+    # The empty maps of this output are expected
+    rm -f /tmp/test.yaml
+}
+
+testAuthoredValues() {
+    authoredValues app
+}
+
+testAuthoredValuesgz() {
+    authoredValues appgz
+}
+
+testJsonToml() {
+    helm values -f 'chart://generated.json,config.toml' test app > /tmp/test.yaml
+
+    check image.tag 1.2.3
+    check ports[1] 443
+    check big 12345678901
+    check global.fromjson true
+
+    # TOML overrides JSON
+    check replicas 4
+    check database.port 5432
+    check users[1].name bob
+    check global.fromtoml yes
+
+    helm values -f 'chart://generated.json?format=toml&strict=true' test app > /dev/null
+    assertNotEquals "A file which cannot be parsed is an error in strict mode" 0 $?
+}
+
+testDocuments() {
+    helm values -f 'chart://documents.yaml' test app > /tmp/test.yaml
+
+    # All the documents, merged in order
+    check replicas 3
+    check image.tag stable
+    check image.pullPolicy Always
+    check logLevel debug
+    check '$doc' ""
+
+    helm values -f 'chart://documents.yaml?doc=overlay' test app > /tmp/test.yaml
+    check replicas 3
+    check image.tag ""
+    check logLevel ""
+
+    helm values -f 'chart://documents.yaml?doc=0,debug' test app > /tmp/test.yaml
+    check replicas 1
+    check logLevel debug
+
+    helm values -f 'chart://documents.yaml?doc=overlya' test app > /dev/null
+    assertEquals "A selected document not found is a warning" 0 $?
+    helm values -f 'chart://documents.yaml?doc=overlya&strict=true' test app > /dev/null
+    assertNotEquals "A selected document not found is an error in strict mode" 0 $?
+}
+
+testPreserve() {
+    helm values -f 'chart://preserved.yaml,over.yaml?preserve=true' test app > /tmp/test.yaml
+
+    check service.port 8080
+    check tags.t4 true
+
+    grep -q '^# Service exposed by the chart$' /tmp/test.yaml
+    assertEquals "Comments are kept" 0 $?
+    grep -q 'type: ClusterIP # no ingress$' /tmp/test.yaml
+    assertEquals "Line comments are kept" 0 $?
+    grep -q "^zone: 'eu-west-1'$" /tmp/test.yaml
+    assertEquals "Quotes are kept" 0 $?
+
+    # Keys in the order of the files
+    assertEquals "Keys are in the order of the files" "service zone apiVersion global tags subchart3" "$(grep -o '^[a-zA-Z0-9]*' /tmp/test.yaml | tr '\n' ' ' | sed 's/ $//')"
+
+    helm values -f 'chart://preserved.yaml?preserve=true&output=json' test app > /dev/null
+    assertNotEquals "preserve needs a yaml output" 0 $?
+}
+
+testOutputFormats() {
+    # Long strings wrapped over several lines
+    helm values -f 'chart://output.yaml?width=40&indent=2' test app > /tmp/test.yaml
+
+    check description "The values of this chart are aggregated from the files of the chart and of its dependencies"
+    check location 'C:\Program Files\app "quoted" $HOME'
+    check args[0] "run the server with a long list of arguments, given one after the other"
+    assertEquals "Lines are wrapped" "" "$(grep -v '^#\|^multiline' /tmp/test.yaml | grep '.\{41\}')"
+    grep -q '^  - "run the server' /tmp/test.yaml
+    assertEquals "Values are indented by 2" 0 $?
+
+    helm values -f 'chart://over.yaml?output=json&indent=0' test app | grep -q '^{"global":{"gv1":"top",'
+    assertEquals "JSON on a single line" 0 $?
+
+    helm values -f 'chart://output.yaml?output=flat' test app > /tmp/test.flat
+    grep -q '^dotted\\.key=one\\, two$' /tmp/test.flat
+    assertEquals "Flat keys and values are escaped" 0 $?
+    grep -q '^args\[0\]=run the server' /tmp/test.flat
+    assertEquals "Flat list items have an index" 0 $?
+    grep -q '^template=\\{id}$' /tmp/test.flat
+    assertEquals "Flat values starting with { are escaped" 0 $?
+    rm -f /tmp/test.flat
+
+    helm values -f 'chart://output.yaml?output=env&width=40' test app | grep -v '^#\|^---' > /tmp/test.env
+    assertEquals "Env lines are wrapped" "" "$(grep '.\{41\}' /tmp/test.env)"
+    assertEquals "Env values" 'C:\Program Files\app "quoted" $HOME' "$(. /tmp/test.env && echo "$LOCATION")"
+    assertEquals "Env list items" "run the server with a long list of arguments, given one after the other" "$(. /tmp/test.env && echo "$ARGS_0")"
+    assertEquals "Env keys" "one, two" "$(. /tmp/test.env && echo "$DOTTED_KEY")"
+    rm -f /tmp/test.env
+
+    helm values -f 'chart://output.yaml,envnames.yaml?output=env' test app > /dev/null
+    assertNotEquals "Values with the same env name are an error" 0 $?
+
+    helm values -f 'chart://output.yaml?indent=1' test app > /dev/null
+    assertNotEquals "YAML needs an indentation of 2 or more" 0 $?
+}
+
+validation() {
+    helm values -f 'chart://valid.yaml?validate=true' test $1 > /tmp/test.yaml
+    assertEquals "Valid values are accepted" 0 $?
+
+    check replicas 2
+    check subchart2.port 9090
+
+    # The default port of subchart2 is required by its schema
+    helm values -f 'chart://over.yaml?validate=true' test $1 > /dev/null
+    assertEquals "Defaults are validated with the values" 0 $?
+
+    ERRORS=$(helm values -f 'chart://invalid.yaml?validate=true' test $1 2>&1 > /dev/null)
+    assertNotEquals "Invalid values are rejected" 0 $?
+    echo "$ERRORS" | grep -q '/replicas: .* from invalid.yaml)'
+    assertEquals "Invalid values of the chart are reported with their file" 0 $?
+    echo "$ERRORS" | grep -q '/subchart2/port: .*schema of subchart2, from invalid.yaml of sub-chart subchart2)'
+    assertEquals "Invalid values of the sub-charts are reported with their file" 0 $?
+
+    helm values -f 'chart://invalid.yaml' test $1 > /dev/null
+    assertEquals "Values are not validated by default" 0 $?
+}
+
+testValidation() {
+    validation app
+}
+
+testValidationgz() {
+    validation appgz
+}
+
+testVerify() {
+    ROCKVALUES_KEYRING=$TOP/verify-keyring.gpg helm values -f 'chart://values-dev.yaml?verify=true' test verify > /tmp/test.yaml
+    assertEquals "Signed sub-charts are accepted" 0 $?
+
+    check top value
+    check signed.signed ok
+
+    helm values --verify --keyring $TOP/verify-keyring.gpg -f chart://values-dev.yaml test verify > /dev/null
+    assertEquals "Sub-charts are verified with helm --verify" 0 $?
+
+    ERRORS=$(ROCKVALUES_KEYRING=$TOP/other-keyring.gpg helm values -f 'chart://values-dev.yaml?verify=true' test verify 2>&1 > /dev/null)
+    assertNotEquals "Sub-charts signed with another key are rejected" 0 $?
+    echo "$ERRORS" | grep -q 'signed-1.0.0.tgz is not verified'
+    assertEquals "Sub-charts not verified are reported" 0 $?
+
+    rm -rf /tmp/verify && cp -r $TOP/verify /tmp/verify && rm /tmp/verify/charts/signed-1.0.0.tgz.prov
+    ERRORS=$(ROCKVALUES_KEYRING=$TOP/verify-keyring.gpg helm values -f 'chart://values-dev.yaml?verify=true' test /tmp/verify 2>&1 > /dev/null)
+    assertNotEquals "Sub-charts without provenance file are rejected" 0 $?
+    echo "$ERRORS" | grep -q 'no provenance file'
+    assertEquals "Missing provenance files are reported" 0 $?
+    rm -rf /tmp/verify
+
+    ROCKVALUES_KEYRING=$TOP/other-keyring.gpg helm values -f chart://values-dev.yaml test verify > /dev/null
+    assertEquals "Sub-charts are not verified by default" 0 $?
+}
+
+testCache() {
+    # Only the cache of the plugin moves: helm keeps its repository cache
+    export HELM_REPOSITORY_CACHE=$(helm env HELM_REPOSITORY_CACHE)
+    export HELM_CACHE_HOME=$(mktemp -d)
+
+    helm values -f chart://extra.yaml test appgz > /tmp/test.yaml
+    check extra value
+    test ! -e $HELM_CACHE_HOME/rockvalues/charts
+    assertEquals "Sub-chart archives are read in memory, not extracted" 0 $?
+
+    helm values -f chart://extra.yaml test appgz > /tmp/test.yaml
+    check extra value
+
+    helm values -f chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:4.12.0 test app > /dev/null
+    helm values -f 'chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:4.12.0?offline=true' test app > /tmp/test.yaml
+    assertEquals "Charts of the cache are used offline" 0 $?
+    check version 4.12.0
+
+    # An archive of the cache which no longer matches its digest is not used
+    tar czf "$(find $HELM_CACHE_HOME/rockvalues/archives -name ingress-nginx-4.12.0.tgz)" -C $TOP app
+    helm values -f 'chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:4.12.0?offline=true' test app > /dev/null
+    assertNotEquals "Archives of the cache changed are not used" 0 $?
+
+    ROCKVALUES_OFFLINE=true helm values -f chart://Chart.yaml@ingress-nginx-valuetest/ingress-nginx:4.11.0 test app > /dev/null
+    assertNotEquals "Charts not in the cache are not pulled offline" 0 $?
+
+    ROCKVALUES_CACHE_MAX_SIZE=0 helm values -f chart://extra.yaml test app > /dev/null
+    assertEquals "The cache is evicted when too large" "" "$(find $HELM_CACHE_HOME/rockvalues/archives -mindepth 1)"
+
+    rm -rf $HELM_CACHE_HOME
+    unset HELM_CACHE_HOME HELM_REPOSITORY_CACHE
+}
+
+testArchivesByContent() {
+    rm -rf /tmp/archives && cp -r $TOP/appgz /tmp/archives
+    mv /tmp/archives/charts/subchart3-1.0.0.tgz /tmp/archives/charts/subchart3
+    echo "not an archive" > /tmp/archives/charts/README
+
+    helm values -f chart://deep.yaml test /tmp/archives > /tmp/test.yaml
+    assertEquals "Archives without extension are read" 0 $?
+    check subchart3.subchart3_1.subchart3_1_1.value deep
+
+    tar czf /tmp/archives.bin -C /tmp archives
+    helm values -f chart://deep.yaml test /tmp/archives.bin > /tmp/test.yaml
+    assertEquals "Local chart archives are read" 0 $?
+    check subchart3.subchart3_1.subchart3_1_1.value deep
+
+    rm -rf /tmp/archives /tmp/archives.bin
+}
+
+testUnvendoredDependencies() {
+    helm values -f chart://values-dev.yaml test dependencies > /tmp/test.yaml
+
+    check top value
+
+    # Dependency read from its file:// repository
+    check shared.shared value
+    check shared.fromparent ok
+}
+
+# Dependencies listed in Chart.lock, downloaded from a chart repository served locally
+testRepositoryDependencies() {
+    if ! command -v python3 > /dev/null; then
+        startSkipping
+    fi
+
+    REPO=$(mktemp -d)
+    CHART=$(mktemp -d)
+    cp -r $TOP/dependencies/lib/shared $CHART/shared
+    sed -i 's/^shared: .*/shared: locked/' $CHART/shared/values-dev.yaml
+    helm package $CHART/shared --version 1.0.0 -d $REPO
+    sed -i 's/^shared: .*/shared: latest/' $CHART/shared/values-dev.yaml
+    helm package $CHART/shared --version 1.0.1 -d $REPO
+    rm -rf $CHART/shared
+    helm repo index $REPO --url http://localhost:8880
+    (cd $REPO && exec python3 -m http.server 8880 > /dev/null 2>&1) &
+    SERVER=$!
+    sleep 1
+
+    cp $TOP/dependencies/Chart.yaml $TOP/dependencies/values-dev.yaml $CHART
+    sed -i 's|repository: .*|repository: http://localhost:8880|' $CHART/Chart.yaml
+    printf 'dependencies:\n- name: shared\n  repository: http://localhost:8880\n  version: 1.0.0\n' > $CHART/Chart.lock
+
+    # Only the cache of the plugin moves: helm keeps its repository cache
+    export HELM_REPOSITORY_CACHE=$(helm env HELM_REPOSITORY_CACHE)
+    export HELM_CACHE_HOME=$(mktemp -d)
+
+    HELM_DEBUG=true helm values -f chart://values-dev.yaml test $CHART > /tmp/test.yaml 2> /tmp/test.log
+    check top value
+    check shared.shared locked
+    check shared.fromparent ok
+    grep -q "Downloading chart" /tmp/test.log
+    assertEquals "Dependencies are downloaded from their repository" 0 $?
+    assertNotEquals "Dependencies are kept in the cache" "" "$(find $HELM_CACHE_HOME/rockvalues/archives -mindepth 1)"
+
+    kill $SERVER
+    ROCKVALUES_OFFLINE=true helm values -f chart://values-dev.yaml test $CHART > /tmp/test.yaml
+    assertEquals "Dependencies of the cache are used offline" 0 $?
+    check shared.shared locked
+
+    # With --dependency-update, the versions of Chart.yaml are used, as helm updates Chart.lock
+    (cd $REPO && exec python3 -m http.server 8880 > /dev/null 2>&1) &
+    SERVER=$!
+    sleep 1
+    helm values -f chart://values-dev.yaml test $CHART --dependency-update > /tmp/test.yaml
+    check shared.shared latest
+    check shared.fromparent ok
+
+    kill $SERVER
+    rm -rf $REPO $CHART $HELM_CACHE_HOME /tmp/test.log
+    unset HELM_CACHE_HOME HELM_REPOSITORY_CACHE
+    endSkipping
+}
+
+
 #===========================================
 
 # Load shunit2